@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/urfave/cli/v2"
+)
+
+// Authentication methods
+const (
+	AuthMethodAuto         = "auto"
+	AuthMethodClientSecret = "clientsecret"
+	AuthMethodClientCert   = "clientcert"
+	AuthMethodFile         = "file"
+	AuthMethodEnvironment  = "env"
+	AuthMethodMSI          = "msi"
+	AuthMethodCLI          = "cli"
+	// AuthMethodNone sends no token. It is for local endpoints such as fake-azure.
+	AuthMethodNone = "none"
+)
+
+// AuthConfig is configuration for authentication to Azure
+type AuthConfig struct {
+	Method              string
+	TenantID            string
+	ClientID            string
+	ClientSecret        string
+	CertificatePath     string
+	CertificatePassword string
+	AuthFile            string
+	// Environment is the cloud to authenticate with (default: public cloud)
+	Environment azure.Environment
+}
+
+// authFlags returns global flags for authentication
+func authFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "authMethod",
+			Value: AuthMethodAuto,
+			Usage: "authentication method (auto|clientsecret|clientcert|file|env|msi|cli|none)",
+		},
+		&cli.StringFlag{
+			Name:  "tenantID",
+			Usage: "tenant ID of the service principal",
+		},
+		&cli.StringFlag{
+			Name:  "clientID",
+			Usage: "client ID of the service principal or the user assigned managed identity",
+		},
+		&cli.StringFlag{
+			Name:    "clientSecret",
+			Usage:   "client secret of the service principal",
+			EnvVars: []string{"ADVISOR_CLIENT_SECRET"},
+		},
+		&cli.StringFlag{
+			Name:  "clientCertificate",
+			Usage: "path to the PKCS#12 certificate of the service principal",
+		},
+		&cli.StringFlag{
+			Name:    "clientCertificatePassword",
+			Usage:   "password of the certificate",
+			EnvVars: []string{"ADVISOR_CLIENT_CERTIFICATE_PASSWORD"},
+		},
+		&cli.StringFlag{
+			Name:  "authFile",
+			Usage: "path to the SDK auth file created by \"az ad sp create-for-rbac --sdk-auth\"",
+		},
+	}
+}
+
+// NewAuthConfig returns *AuthConfig from global flags
+func NewAuthConfig(c *cli.Context) *AuthConfig {
+	return &AuthConfig{
+		Method:              c.String("authMethod"),
+		TenantID:            c.String("tenantID"),
+		ClientID:            c.String("clientID"),
+		ClientSecret:        c.String("clientSecret"),
+		CertificatePath:     c.String("clientCertificate"),
+		CertificatePassword: c.String("clientCertificatePassword"),
+		AuthFile:            c.String("authFile"),
+	}
+}
+
+// resolveMethod decides authentication method when Method is auto.
+// The order is:
+// 1. Client secret (--clientSecret)
+// 2. Client certificate (--clientCertificate)
+// 3. Auth file (--authFile or AZURE_AUTH_LOCATION)
+// 4. Environment variables (AZURE_TENANT_ID and AZURE_CLIENT_ID)
+// 5. Azure CLI
+// Managed identity is used only when it is specified explicitly.
+func (ac *AuthConfig) resolveMethod() string {
+	if ac.Method != "" && ac.Method != AuthMethodAuto {
+		return ac.Method
+	}
+	switch {
+	case ac.ClientSecret != "":
+		return AuthMethodClientSecret
+	case ac.CertificatePath != "":
+		return AuthMethodClientCert
+	case ac.AuthFile != "" || os.Getenv("AZURE_AUTH_LOCATION") != "":
+		return AuthMethodFile
+	case os.Getenv(auth.TenantID) != "" && os.Getenv(auth.ClientID) != "":
+		return AuthMethodEnvironment
+	}
+	return AuthMethodCLI
+}
+
+// environment returns Environment, or the public cloud when it is not set
+func (ac *AuthConfig) environment() azure.Environment {
+	if ac.Environment.ActiveDirectoryEndpoint == "" {
+		return azure.PublicCloud
+	}
+	return ac.Environment
+}
+
+// NewAuthorizer returns autorest.Authorizer for Azure Resource Manager with the resolved authentication method
+func (ac *AuthConfig) NewAuthorizer() (autorest.Authorizer, error) {
+	env := ac.environment()
+	if env.TokenAudience != "" {
+		return ac.NewAuthorizerWithResource(env.TokenAudience)
+	}
+	return ac.NewAuthorizerWithResource(env.ResourceManagerEndpoint)
+}
+
+// NewAuthorizerWithResource returns autorest.Authorizer for the resource with the resolved authentication method
+func (ac *AuthConfig) NewAuthorizerWithResource(resource string) (autorest.Authorizer, error) {
+	method := ac.resolveMethod()
+	a, err := ac.newAuthorizer(method, resource)
+	if err != nil {
+		return nil, fmt.Errorf("authentication failed (method: %s): %v", method, err)
+	}
+	return a, nil
+}
+
+func (ac *AuthConfig) newAuthorizer(method string, resource string) (autorest.Authorizer, error) {
+	switch method {
+	case AuthMethodClientSecret:
+		if ac.TenantID == "" || ac.ClientID == "" || ac.ClientSecret == "" {
+			return nil, fmt.Errorf("tenantID, clientID and clientSecret are required")
+		}
+		config := auth.NewClientCredentialsConfig(ac.ClientID, ac.ClientSecret, ac.TenantID)
+		config.AADEndpoint = ac.environment().ActiveDirectoryEndpoint
+		config.Resource = resource
+		return config.Authorizer()
+	case AuthMethodClientCert:
+		if ac.TenantID == "" || ac.ClientID == "" || ac.CertificatePath == "" {
+			return nil, fmt.Errorf("tenantID, clientID and clientCertificate are required")
+		}
+		config := auth.NewClientCertificateConfig(ac.CertificatePath, ac.CertificatePassword, ac.ClientID, ac.TenantID)
+		config.AADEndpoint = ac.environment().ActiveDirectoryEndpoint
+		config.Resource = resource
+		return config.Authorizer()
+	case AuthMethodFile:
+		// SDK は AZURE_AUTH_LOCATION からのみファイルの場所を読み込む
+		if ac.AuthFile != "" {
+			if err := os.Setenv("AZURE_AUTH_LOCATION", ac.AuthFile); err != nil {
+				return nil, err
+			}
+		}
+		return auth.NewAuthorizerFromFileWithResource(resource)
+	case AuthMethodEnvironment:
+		// AZURE_ENVIRONMENT は --cloud で解決済みのため、環境名のエラーは無視して --cloud の環境で上書きする
+		settings, _ := auth.GetSettingsFromEnvironment()
+		settings.Environment = ac.environment()
+		settings.Values[auth.Resource] = resource
+		return settings.GetAuthorizer()
+	case AuthMethodMSI:
+		msi := auth.NewMSIConfig()
+		msi.ClientID = ac.ClientID
+		msi.Resource = resource
+		return msi.Authorizer()
+	case AuthMethodCLI:
+		// Azure CLI は az cloud set で選択したクラウドのトークンを返す
+		return auth.NewAuthorizerFromCLIWithResource(resource)
+	case AuthMethodNone:
+		return autorest.NullAuthorizer{}, nil
+	}
+	return nil, fmt.Errorf("unknown authentication method: %s", method)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+)
+
+func TestResolveMethod(t *testing.T) {
+	envNames := []string{"AZURE_AUTH_LOCATION", auth.TenantID, auth.ClientID}
+	// 実行環境の変数に影響されないよう、退避して終了時に戻す
+	for _, name := range envNames {
+		if v, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, v)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		config AuthConfig
+		env    map[string]string
+		want   string
+	}{
+		{"no credentials", AuthConfig{}, nil, AuthMethodCLI},
+		{"auto without credentials", AuthConfig{Method: AuthMethodAuto}, nil, AuthMethodCLI},
+		{"secret", AuthConfig{Method: AuthMethodAuto, ClientSecret: "secret"}, nil, AuthMethodClientSecret},
+		{"secret over cert", AuthConfig{ClientSecret: "secret", CertificatePath: "cert.pfx", AuthFile: "auth.json"}, nil, AuthMethodClientSecret},
+		{"cert over file", AuthConfig{CertificatePath: "cert.pfx", AuthFile: "auth.json"}, map[string]string{auth.TenantID: "tenant", auth.ClientID: "client"}, AuthMethodClientCert},
+		{"file flag over env", AuthConfig{AuthFile: "auth.json"}, map[string]string{auth.TenantID: "tenant", auth.ClientID: "client"}, AuthMethodFile},
+		{"file env over env", AuthConfig{}, map[string]string{"AZURE_AUTH_LOCATION": "auth.json", auth.TenantID: "tenant", auth.ClientID: "client"}, AuthMethodFile},
+		{"env", AuthConfig{}, map[string]string{auth.TenantID: "tenant", auth.ClientID: "client"}, AuthMethodEnvironment},
+		{"env without client ID", AuthConfig{}, map[string]string{auth.TenantID: "tenant"}, AuthMethodCLI},
+		{"env without tenant ID", AuthConfig{}, map[string]string{auth.ClientID: "client"}, AuthMethodCLI},
+		// マネージド ID は自動では選ばれない
+		{"client ID flag only", AuthConfig{ClientID: "client"}, nil, AuthMethodCLI},
+		{"explicit msi", AuthConfig{Method: AuthMethodMSI, ClientSecret: "secret"}, nil, AuthMethodMSI},
+		{"explicit cli", AuthConfig{Method: AuthMethodCLI, ClientSecret: "secret"}, map[string]string{auth.TenantID: "tenant", auth.ClientID: "client"}, AuthMethodCLI},
+		{"explicit none", AuthConfig{Method: AuthMethodNone, AuthFile: "auth.json"}, nil, AuthMethodNone},
+	}
+	for _, tt := range tests {
+		for _, name := range envNames {
+			os.Unsetenv(name)
+		}
+		for name, v := range tt.env {
+			os.Setenv(name, v)
+		}
+		if got := tt.config.resolveMethod(); got != tt.want {
+			t.Errorf("%s: resolveMethod() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,77 +2,208 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"reflect"
 	"strings"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
 	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights/insightsapi"
 	"github.com/Azure/azure-sdk-for-go/services/resourcegraph/mgmt/2019-04-01/resourcegraph"
-	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/urfave/cli/v2"
 )
 
 // FetchMetricDataInput is input parameters for FetchMetricData
 type FetchMetricDataInput struct {
-	subscriptionID   string
-	resourceGroup    string
-	namespace        string
-	resource         string
-	metricNames      []string
-	aggregation      string
-	timeDurationHour int
+	resourceID   ResourceID
+	metricNames  []string
+	aggregations []string
+	window       MetricWindow
 }
 
 // FetchMetricDefinitionsInput is input parameters for FetchMetricDefinitions
 type FetchMetricDefinitionsInput struct {
-	subscriptionID  string
-	resourceGroup   string
-	namespace       string
-	resource        string
-	resourceURI     string
+	resourceID      ResourceID
 	metricnamespace string
 }
 
 type ResourceGraphQueryRequestInput struct {
-	subscriptionID string
-	query          string
-	facets         []string
+	subscriptionIDs []string
+	query           string
+	facets          []string
 }
 
 // Client is an API Client for Azure
 type Client struct {
-	SubscriptionID          string
-	MetricsClient           insightsapi.MetricsClientAPI
-	MetricDefinitionsClient insightsapi.MetricDefinitionsClientAPI
-	ResourceGraphClient     resourcegraph.OperationsClient
+	SubscriptionIDs          []string
+	MetricsClients           map[string]insightsapi.MetricsClientAPI
+	MetricDefinitionsClients map[string]insightsapi.MetricDefinitionsClientAPI
+	ResourceGraphClient      resourcegraph.OperationsClient
+	MetricsBatchClient       *MetricsBatchClient
+	ResourceGraphLimiter     *Limiter
+	MetricsLimiter           *Limiter
+	RetryPolicy              RetryPolicy
+	RetryStats               *RetryStats
+	MetricWindow             MetricWindow
+}
+
+// ClientOptions is optional settings of Client
+type ClientOptions struct {
+	// Sender sends all requests of the client when it is not nil
+	Sender autorest.Sender
+	// ResourceManagerEndpoint is the base URI of Azure Resource Manager (default: public cloud)
+	ResourceManagerEndpoint string
+	// MetricsBatchEndpoint is the endpoint of the metrics batch API with {region} placeholder.
+	// The batch API is not used when it is empty and ResourceManagerEndpoint is customized.
+	MetricsBatchEndpoint string
+}
+
+// resourceManagerEndpoint returns the base URI of Azure Resource Manager
+func (o *ClientOptions) resourceManagerEndpoint() string {
+	if o == nil || o.ResourceManagerEndpoint == "" {
+		return azure.PublicCloud.ResourceManagerEndpoint
+	}
+	return o.ResourceManagerEndpoint
+}
+
+// metricsBatchEndpoint returns the endpoint of the metrics batch API, or empty when it is not available
+func (o *ClientOptions) metricsBatchEndpoint() string {
+	if o == nil || (o.MetricsBatchEndpoint == "" && o.ResourceManagerEndpoint == "") {
+		return metricsBatchEndpoint
+	}
+	return o.MetricsBatchEndpoint
 }
 
 // NewClient returns *Client with setting Authorizer
-func NewClient(subscriptionID string) (*Client, error) {
-	//a, err := auth.NewAuthorizerFromFile(azure.PublicCloud.ResourceManagerEndpoint)
-	a, err := auth.NewAuthorizerFromCLI()
+func NewClient(ctx context.Context, scope *SubscriptionScope, authConfig *AuthConfig, options *ClientOptions) (*Client, error) {
+	a, err := authConfig.NewAuthorizer()
+	if err != nil {
+		return &Client{}, err
+	}
+
+	subscriptionIDs, err := scope.Resolve(ctx, a, options.resourceManagerEndpoint())
 	if err != nil {
 		return &Client{}, err
 	}
 
-	metricsClient := insights.NewMetricsClient(subscriptionID)
-	metricsClient.Authorizer = a
+	return newClient(subscriptionIDs, a, options), nil
+}
+
+// newClient returns *Client for the subscriptions
+func newClient(subscriptionIDs []string, a autorest.Authorizer, options *ClientOptions) *Client {
+	if options == nil {
+		options = &ClientOptions{}
+	}
+	endpoint := options.resourceManagerEndpoint()
+
+	// メトリックのクライアントはサブスクリプションごとに作成する
+	metricsClients := map[string]insightsapi.MetricsClientAPI{}
+	metricDefinitionsClients := map[string]insightsapi.MetricDefinitionsClientAPI{}
+	for _, id := range subscriptionIDs {
+		metricsClient := insights.NewMetricsClientWithBaseURI(endpoint, id)
+		metricsClient.Authorizer = a
+		metricsClient.Sender = options.Sender
+		metricsClients[strings.ToLower(id)] = metricsClient
 
-	metricDefinitionsClient := insights.NewMetricDefinitionsClient(subscriptionID)
-	metricDefinitionsClient.Authorizer = a
+		metricDefinitionsClient := insights.NewMetricDefinitionsClientWithBaseURI(endpoint, id)
+		metricDefinitionsClient.Authorizer = a
+		metricDefinitionsClient.Sender = options.Sender
+		metricDefinitionsClients[strings.ToLower(id)] = metricDefinitionsClient
+	}
 
-	resourceGraphClient := resourcegraph.NewOperationsClient()
+	resourceGraphClient := resourcegraph.NewOperationsClientWithBaseURI(endpoint)
 	resourceGraphClient.Authorizer = a
+	resourceGraphClient.Sender = options.Sender
 
 	return &Client{
-		SubscriptionID:          subscriptionID,
-		MetricsClient:           metricsClient,
-		MetricDefinitionsClient: metricDefinitionsClient,
-		ResourceGraphClient:     resourceGraphClient,
-	}, nil
+		SubscriptionIDs:          subscriptionIDs,
+		MetricsClients:           metricsClients,
+		MetricDefinitionsClients: metricDefinitionsClients,
+		ResourceGraphClient:      resourceGraphClient,
+		ResourceGraphLimiter:     NewLimiter("Resource Graph", DefaultResourceGraphConcurrency, true),
+		MetricsLimiter:           NewLimiter("Metrics", QueryConcurrency, true),
+		RetryPolicy:              DefaultRetryPolicy,
+		RetryStats:               &RetryStats{},
+		MetricWindow:             DefaultMetricWindow,
+	}
+}
+
+// newClientFromContext returns *Client configured by global flags
+func newClientFromContext(ctx context.Context, c *cli.Context) (*Client, error) {
+	return newScopedClientFromContext(ctx, c, NewSubscriptionScope(c))
+}
+
+// newScopedClientFromContext returns *Client of the scope configured by global flags
+func newScopedClientFromContext(ctx context.Context, c *cli.Context, scope *SubscriptionScope) (*Client, error) {
+	window, err := NewMetricWindow(c)
+	if err != nil {
+		return &Client{}, err
+	}
+	if c.String("record") != "" && c.String("replay") != "" {
+		return &Client{}, fmt.Errorf("--record and --replay can not be used together")
+	}
+
+	var client *Client
+	if dir := c.String("replay"); dir != "" {
+		client, err = NewReplayClient(dir)
+		if err != nil {
+			return client, err
+		}
+	} else {
+		client, err = newRecordingClientFromContext(ctx, c, scope)
+		if err != nil {
+			return client, err
+		}
+	}
+	client.MetricWindow = window
+	client.RetryPolicy.MaxAttempts = c.Int("maxRetryAttempts")
+	client.RetryPolicy.RequestTimeout = c.Duration("requestTimeout")
+	client.ResourceGraphLimiter = NewLimiter("Resource Graph", c.Int("resourceGraphConcurrency"), c.Bool("adaptiveConcurrency"))
+	client.MetricsLimiter = NewLimiter("Metrics", c.Int("concurrency"), c.Bool("adaptiveConcurrency"))
+	return client, nil
+}
+
+// newRecordingClientFromContext returns *Client which records the traffic when --record is specified
+func newRecordingClientFromContext(ctx context.Context, c *cli.Context, scope *SubscriptionScope) (*Client, error) {
+	cloud, err := newCloudFromContext(c)
+	if err != nil {
+		return &Client{}, err
+	}
+	options := newClientOptions(c, cloud)
+	var recorder *Recorder
+	if dir := c.String("record"); dir != "" {
+		recorder, err = NewRecorder(dir)
+		if err != nil {
+			return &Client{}, err
+		}
+		options.Sender = recorder.Sender(autorest.CreateSender())
+	}
+
+	authConfig := NewAuthConfig(c)
+	authConfig.Environment = cloud.Environment
+	client, err := NewClient(ctx, scope, authConfig, options)
+	if err != nil {
+		return client, err
+	}
+	// メトリックのバッチ API は別の audience のトークンが必要なため、取得できない場合はリソースごとに取得する
+	if c.Bool("metricsBatch") && options.metricsBatchEndpoint() != "" {
+		a, err := authConfig.NewAuthorizerWithResource(metricsBatchResource(options.metricsBatchEndpoint()))
+		if err != nil {
+			logger.Warn("metrics batch API is disabled", "error", err)
+		} else {
+			client.MetricsBatchClient = NewMetricsBatchClient(a)
+			client.MetricsBatchClient.Endpoint = options.metricsBatchEndpoint()
+			client.MetricsBatchClient.Sender = options.Sender
+		}
+	}
+	if recorder != nil {
+		if err := recorder.WriteManifest(client); err != nil {
+			return client, err
+		}
+	}
+	return client, nil
 }
 
 type metricDefinitionsListInput struct {
@@ -96,16 +227,24 @@ type metricsListInput struct {
 }
 
 func (c *Client) metricDefinitionsList(ctx context.Context, params *metricDefinitionsListInput) (insights.MetricDefinitionCollection, error) {
-	return c.MetricDefinitionsClient.List(
-		ctx,
+	client, ok := c.MetricDefinitionsClients[strings.ToLower(params.subscriptionID)]
+	if !ok {
+		return insights.MetricDefinitionCollection{}, fmt.Errorf("subscription %s is not in the target scope", params.subscriptionID)
+	}
+	return client.List(
+		c.withRetry(ctx, c.MetricsLimiter),
 		params.resourceURI,
 		params.metricnamespace,
 	)
 }
 
 func (c *Client) metricsList(ctx context.Context, params *metricsListInput) (insights.Response, error) {
-	return c.MetricsClient.List(
-		ctx,
+	client, ok := c.MetricsClients[strings.ToLower(params.subscriptionID)]
+	if !ok {
+		return insights.Response{}, fmt.Errorf("subscription %s is not in the target scope", params.subscriptionID)
+	}
+	return client.List(
+		c.withRetry(ctx, c.MetricsLimiter),
 		params.resourceURI,
 		params.timespan,
 		params.interval,
@@ -122,13 +261,8 @@ func (c *Client) metricsList(ctx context.Context, params *metricsListInput) (ins
 // FetchMetricDefinitions returns metric definitions
 func FetchMetricDefinitions(ctx context.Context, c *Client, params FetchMetricDefinitionsInput) (*[]insights.MetricDefinition, error) {
 	input := &metricDefinitionsListInput{
-		subscriptionID: params.subscriptionID,
-		resourceURI: fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/%s/%s",
-			params.subscriptionID,
-			params.resourceGroup,
-			params.namespace,
-			params.resource,
-		),
+		subscriptionID:  params.resourceID.SubscriptionID,
+		resourceURI:     params.resourceID.String(),
 		metricnamespace: params.metricnamespace,
 	}
 	res, err := c.metricDefinitionsList(ctx, input)
@@ -138,11 +272,37 @@ func FetchMetricDefinitions(ctx context.Context, c *Client, params FetchMetricDe
 	return res.Value, nil
 }
 
-// FetchMetricData fetches metric data and returns latest value with metric name as hash key
+// MetricAggregationValue returns the value of the aggregation type of the metric value
+func MetricAggregationValue(d insights.MetricValue, aggregation string) *float64 {
+	switch aggregation {
+	case "Average":
+		return d.Average
+	case "Maximum":
+		return d.Maximum
+	case "Minimum":
+		return d.Minimum
+	case "Total":
+		return d.Total
+	case "Count":
+		return d.Count
+	}
+	return nil
+}
+
+// hasAggregation returns true when the metric value has any of the aggregations
+func hasAggregation(d insights.MetricValue, aggregations []string) bool {
+	for _, a := range aggregations {
+		if MetricAggregationValue(d, a) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// FetchMetricData fetches metric data of all aggregations in one request and returns values with metric name as hash key.
+// Values which have none of the aggregations are skipped.
 func FetchMetricData(ctx context.Context, c *Client, params FetchMetricDataInput) (map[string][]insights.MetricValue, error) {
-	endTime := time.Now().UTC()
-	startTime := endTime.Add(time.Duration(-1*params.timeDurationHour) * time.Hour)
-	timespan := fmt.Sprintf("%s/%s", startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
+	timespan := params.window.Timespan(time.Now())
 
 	var metricNames []string
 	const metricsCountLimitPerRequest int = 20
@@ -160,18 +320,13 @@ func FetchMetricData(ctx context.Context, c *Client, params FetchMetricDataInput
 	for _, m := range metricNames {
 		//metrics := make(map[string]*insights.MetricValue)
 		input := &metricsListInput{
-			subscriptionID: params.subscriptionID,
-			resourceURI: fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/%s/%s",
-				params.subscriptionID,
-				params.resourceGroup,
-				params.namespace,
-				params.resource,
-			),
-			timespan:    timespan,
-			interval:    to.StringPtr("PT24H"),
-			aggregation: params.aggregation,
-			metricnames: m,
-			resultType:  insights.Data,
+			subscriptionID: params.resourceID.SubscriptionID,
+			resourceURI:    params.resourceID.String(),
+			timespan:       timespan,
+			interval:       to.StringPtr(params.window.Interval),
+			aggregation:    strings.Join(params.aggregations, ","),
+			metricnames:    m,
+			resultType:     insights.Data,
 		}
 		res, err := c.metricsList(ctx, input)
 		if err != nil {
@@ -181,9 +336,7 @@ func FetchMetricData(ctx context.Context, c *Client, params FetchMetricDataInput
 		for _, v := range *res.Value {
 			for _, elem := range *v.Timeseries {
 				for _, d := range *elem.Data {
-					rv := reflect.ValueOf(d)
-					av := rv.FieldByName(params.aggregation)
-					if av.IsNil() {
+					if !hasAggregation(d, params.aggregations) {
 						continue
 					}
 
@@ -198,40 +351,3 @@ func FetchMetricData(ctx context.Context, c *Client, params FetchMetricDataInput
 	}
 	return metricsList, nil
 }
-
-func FetchResourceGraphData(c context.Context, client *Client, params ResourceGraphQueryRequestInput, v interface{}) ([]interface{}, error) {
-	var facetRequest []resourcegraph.FacetRequest
-	for i := 0; i < len(params.facets); i++ {
-		facetRequest = append(
-			facetRequest,
-			resourcegraph.FacetRequest{
-				Expression: &params.facets[i],
-			},
-		)
-	}
-	request := &resourcegraph.QueryRequest{
-		Subscriptions: &[]string{params.subscriptionID},
-		Query:         &params.query,
-		Options:       &resourcegraph.QueryRequestOptions{ResultFormat: resourcegraph.ResultFormatObjectArray},
-		Facets:        &facetRequest,
-	}
-	queryResponse, err := client.ResourceGraphClient.Resources(c, *request)
-	if err != nil {
-		return nil, err
-	}
-
-	var result []interface{}
-	for _, elem := range queryResponse.Data.([]interface{}) {
-		b, err := json.Marshal(elem)
-		if err != nil {
-			return nil, err
-		}
-		r := reflect.New(reflect.TypeOf(v).Elem()).Interface()
-		errUnmarshal := json.Unmarshal(b, &r)
-		if errUnmarshal != nil {
-			return nil, errUnmarshal
-		}
-		result = append(result, r)
-	}
-	return result, nil
-}
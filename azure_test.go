@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights/insightsapi"
+	"github.com/Azure/azure-sdk-for-go/services/resourcegraph/mgmt/2019-04-01/resourcegraph"
+)
+
+func TestFetchResourceGraphRowsPaging(t *testing.T) {
+	pages := []map[string]interface{}{
+		{
+			"totalRecords": 3,
+			"count":        2,
+			"data":         []map[string]string{{"id": "vm1"}, {"id": "vm2"}},
+			"$skipToken":   "token1",
+		},
+		{
+			"totalRecords": 3,
+			"count":        1,
+			"data":         []map[string]string{{"id": "vm3"}},
+		},
+	}
+	var requests []resourcegraph.QueryRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req resourcegraph.QueryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			// ハンドラーは別の goroutine で実行されるため Fatal は使わない
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		page := pages[len(requests)]
+		requests = append(requests, req)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer server.Close()
+
+	client := &Client{
+		ResourceGraphClient: resourcegraph.NewOperationsClientWithBaseURI(server.URL),
+		RetryPolicy:         DefaultRetryPolicy,
+		RetryStats:          &RetryStats{},
+	}
+	params := ResourceGraphQueryRequestInput{
+		subscriptionIDs: []string{"sub"},
+		query:           "resources",
+	}
+	var rows rawRows
+	stats, err := FetchResourceGraphRows(context.Background(), client, params, &rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Errorf("rows = %d, want 3", len(rows))
+	}
+	if stats.TotalRecords != 3 || stats.Returned != 3 || stats.Truncated {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("requests = %d, want 2", len(requests))
+	}
+	if requests[1].Options.SkipToken == nil || *requests[1].Options.SkipToken != "token1" {
+		t.Errorf("second request does not have $skipToken")
+	}
+}
+
+func TestDecodeResourceGraphPage(t *testing.T) {
+	body := `{"totalRecords": 2, "count": 2, "facets": [], "data": [
+		{"id": "/disks/a", "name": "a", "properties": {"diskSizeGB": 128}},
+		{"id": "/disks/b", "name": "b", "properties": {"diskSizeGB": "large"}}
+	]}`
+	var disks Disks
+	page, err := decodeResourceGraphPage(strings.NewReader(body), &disks, 10)
+	rowErr, ok := err.(*ResourceGraphRowError)
+	if !ok {
+		t.Fatalf("err = %v, want *ResourceGraphRowError", err)
+	}
+	// エラーにはページをまたいだ行番号、リソース ID、フィールドが含まれること
+	if rowErr.Row != 11 || rowErr.ID != "/disks/b" || rowErr.Field != "properties.diskSizeGB" {
+		t.Errorf("row error = %+v", rowErr)
+	}
+	if page.Rows != 1 || len(disks) != 1 || disks[0].Properties.DiskSizeGB != 128 {
+		t.Errorf("decoded %d rows: %+v", page.Rows, disks)
+	}
+
+	var rows rawRows
+	page, err = decodeResourceGraphPage(strings.NewReader(`{"data": [{"id": "x"}], "totalRecords": 5, "count": 1, "resultTruncated": "true", "$skipToken": "t"}`), &rows, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.TotalRecords != 5 || page.Count != 1 || page.ResultTruncated != "true" || page.SkipToken != "t" || len(rows) != 1 {
+		t.Errorf("page = %+v, rows = %d", page, len(rows))
+	}
+}
+
+func TestFetchMetricDataAggregations(t *testing.T) {
+	var aggregations, paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aggregations = append(aggregations, r.URL.Query().Get("aggregation"))
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"value":[{"name":{"value":"Percentage CPU"},"timeseries":[{"data":[
+			{"timeStamp":"2020-03-01T00:00:00Z","average":10,"maximum":50},
+			{"timeStamp":"2020-03-02T00:00:00Z"},
+			{"timeStamp":"2020-03-03T00:00:00Z","average":20,"maximum":80}
+		]}]}]}`))
+	}))
+	defer server.Close()
+
+	client := &Client{
+		MetricsClients: map[string]insightsapi.MetricsClientAPI{
+			"sub": insights.NewMetricsClientWithBaseURI(server.URL, "sub"),
+		},
+		RetryPolicy: DefaultRetryPolicy,
+		RetryStats:  &RetryStats{},
+	}
+	resourceID, err := ParseResourceID("/subscriptions/sub/resourcegroups/RG/providers/microsoft.sql/servers/sql1/databases/db1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := FetchMetricDataInput{
+		resourceID:   resourceID,
+		aggregations: []string{"Average", "Maximum"},
+		metricNames:  []string{"Percentage CPU"},
+		window:       DefaultMetricWindow,
+	}
+	metrics, err := FetchMetricData(context.Background(), client, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aggregations) != 1 || aggregations[0] != "Average,Maximum" {
+		t.Errorf("aggregation parameters = %v", aggregations)
+	}
+	// Resource Graph が返した子リソースの ID が大文字小文字も含めてそのままパスになること
+	if !strings.HasSuffix(paths[0], "/subscriptions/sub/resourcegroups/RG/providers/microsoft.sql/servers/sql1/databases/db1/providers/microsoft.insights/metrics") {
+		t.Errorf("path = %s", paths[0])
+	}
+	values := metrics["Percentage CPU"]
+	if len(values) != 2 {
+		t.Fatalf("values = %d, want 2", len(values))
+	}
+	if *MetricAggregationValue(values[1], "Maximum") != 80 {
+		t.Errorf("unexpected maximum: %v", *values[1].Maximum)
+	}
+}
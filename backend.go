@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
+)
+
+// ResourceInventory lists resources with Resource Graph queries
+type ResourceInventory interface {
+	// QueryResources decodes all rows of the query into rows
+	QueryResources(ctx context.Context, params ResourceGraphQueryRequestInput, rows ResourceGraphRows) (ResourceGraphQueryStats, error)
+	// ResourceGraphConcurrency returns the maximum number of concurrent queries
+	ResourceGraphConcurrency() int
+}
+
+// MetricsSource fetches metrics of resources
+type MetricsSource interface {
+	// MetricsBatchSize returns the maximum number of targets passed to FetchMetrics at once
+	MetricsBatchSize() int
+	// MetricsConcurrency returns the maximum number of concurrent FetchMetrics calls
+	MetricsConcurrency() int
+	// MetricsInterval returns the interval of metrics fetched by FetchMetrics
+	MetricsInterval() string
+	// MetricDefinitions returns the metric definitions of the resource
+	MetricDefinitions(ctx context.Context, resourceID string) ([]insights.MetricDefinition, error)
+	// FetchMetrics fetches metrics of the targets which share subscription, region and namespace.
+	// Targets which were not fetched because of interruption are omitted from the result.
+	FetchMetrics(ctx context.Context, targets []MetricTarget, query MetricQuery) []TargetMetrics
+}
+
+// TargetMetrics is metrics of a target with metric name as hash key, or the error
+type TargetMetrics struct {
+	// Index is the index of the target passed to FetchMetrics
+	Index   int
+	Metrics map[string][]insights.MetricValue
+	Err     error
+}
+
+var (
+	_ ResourceInventory = (*Client)(nil)
+	_ MetricsSource     = (*Client)(nil)
+)
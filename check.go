@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Check finds resources to report with Resource Graph and metrics.
+// A subcommand is generated for each check in checkRegistry.
+type Check interface {
+	// ID is the name of the subcommand and of the check in the results such as vm
+	ID() string
+	// Description is the usage of the subcommand
+	Description() string
+	// OutputName is the base name of the report files such as result_vms
+	OutputName() string
+	// Categories is the sections of the report in order
+	Categories() []Category
+	// Inventory queries the resources to evaluate with Resource Graph
+	Inventory(ctx context.Context, env *CheckEnv) (interface{}, error)
+	// Evaluate returns the findings of the resources returned by Inventory
+	Evaluate(ctx context.Context, env *CheckEnv, resources interface{}) ([]Finding, error)
+}
+
+// CheckEnv is the clients and the state of a run passed to checks
+type CheckEnv struct {
+	Inventory       ResourceInventory
+	Metrics         MetricsSource
+	SubscriptionIDs []string
+	Errors          *EvaluationErrors
+}
+
+// checkRegistry is the checks in the order of the subcommands and of the all command
+var checkRegistry = []Check{
+	diskCheck{},
+	vmCheck{},
+	hdinsightCheck{},
+}
+
+// checkCommands returns a subcommand of each check, the all command and the list-checks command
+func checkCommands() []*cli.Command {
+	var commands []*cli.Command
+	for _, check := range checkRegistry {
+		check := check
+		commands = append(commands, &cli.Command{
+			Name:  check.ID(),
+			Usage: check.Description(),
+			Action: func(c *cli.Context) error {
+				return RunChecks(c, []Check{check}, check.ID(), check.OutputName())
+			},
+			Flags: append(metricWindowFlags(false), outputFlags(false)...),
+		})
+	}
+	allFlags := []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "checks",
+			Usage: "checks to run (can be specified multiple times or separated by comma, default: all checks)",
+		},
+	}
+	allFlags = append(allFlags, metricWindowFlags(false)...)
+	allFlags = append(allFlags, outputFlags(false)...)
+	commands = append(commands,
+		&cli.Command{
+			Name:   "all",
+			Usage:  "Run the checks sharing resources and metrics, and write a report of all checks",
+			Action: RunAll,
+			Flags:  allFlags,
+		},
+		&cli.Command{
+			Name:   "list-checks",
+			Usage:  "List the checks with their report sections",
+			Action: ListChecks,
+		},
+	)
+	return commands
+}
+
+// RunAll runs the checks selected with --checks and writes result_all
+func RunAll(c *cli.Context) error {
+	checks, err := selectChecks(c.StringSlice("checks"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), UNKNOWN)
+	}
+	return RunChecks(c, checks, "all", "result_all")
+}
+
+// selectChecks returns the registered checks of the IDs in the order of checkRegistry, or all checks when no ID is given
+func selectChecks(values []string) ([]Check, error) {
+	selected := map[string]bool{}
+	for _, v := range values {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				selected[strings.ToLower(id)] = true
+			}
+		}
+	}
+	if len(selected) == 0 {
+		return checkRegistry, nil
+	}
+
+	var checks []Check
+	var available []string
+	for _, check := range checkRegistry {
+		available = append(available, check.ID())
+		if selected[check.ID()] {
+			checks = append(checks, check)
+			delete(selected, check.ID())
+		}
+	}
+	if len(selected) > 0 {
+		var unknown []string
+		for id := range selected {
+			unknown = append(unknown, id)
+		}
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown checks: %s (available: %s)", strings.Join(unknown, ", "), strings.Join(available, ", "))
+	}
+	return checks, nil
+}
+
+// ListChecks prints the registered checks
+func ListChecks(c *cli.Context) error {
+	return writeChecks(c.App.Writer, checkRegistry)
+}
+
+// writeChecks writes the checks as a table
+func writeChecks(w io.Writer, checks []Check) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tDESCRIPTION\tCATEGORIES")
+	for _, check := range checks {
+		var categories []string
+		for _, category := range check.Categories() {
+			categories = append(categories, category.ID)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", check.ID(), check.Description(), strings.Join(categories, ","))
+	}
+	return tw.Flush()
+}
+
+// RunChecks runs the checks in order and writes a report of their findings.
+// Resources and metrics are shared between the checks, so that they are fetched once.
+func RunChecks(c *cli.Context, checks []Check, name string, outputName string) error {
+	opts, err := newOutputOptions(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := newRunContext(c)
+	defer cancel()
+
+	client, err := newClientFromContext(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer client.RetryStats.Log()
+
+	env := &CheckEnv{
+		Inventory:       newSharedInventory(client),
+		Metrics:         newSharedMetrics(client),
+		SubscriptionIDs: client.SubscriptionIDs,
+		Errors:          NewEvaluationErrors(c.Bool("abortOnError")),
+	}
+	var findings []Finding
+	var categories []Category
+	var ran []string
+	for i, check := range checks {
+		f, err := runCheck(ctx, check, env)
+		if err != nil {
+			reason := incompleteReason(ctx)
+			if reason == "" {
+				return err
+			}
+			// 中断やタイムアウトで失敗したチェックは結果に含めず、それまでのチェックの結果を出力する
+			logger.Warn("check stopped", "check", check.ID(), "reason", reason, "error", err)
+			logSkippedChecks(checks[i+1:], reason)
+			break
+		}
+		if env.Errors.Aborted() {
+			return env.Errors.ExitError()
+		}
+		findings = append(findings, f...)
+		categories = append(categories, check.Categories()...)
+		ran = append(ran, check.ID())
+
+		// 中断された場合は残りのチェックを実行せず、それまでの結果を出力する
+		if reason := incompleteReason(ctx); reason != "" {
+			logSkippedChecks(checks[i+1:], reason)
+			break
+		}
+	}
+
+	info := &ReportInfo{
+		EvaluationErrors: env.Errors.List(),
+		Incomplete:       incompleteReason(ctx),
+		MetricWindow:     client.MetricWindow,
+		Checks:           ran,
+	}
+	report := NewFindingsReport(name, client.SubscriptionIDs, info, categories, findings)
+	if err := outputReport(report, opts, outputName); err != nil {
+		return err
+	}
+	return runExitError(ctx, env.Errors)
+}
+
+// logSkippedChecks logs the checks which are not run because the run did not complete
+func logSkippedChecks(checks []Check, reason string) {
+	if len(checks) == 0 {
+		return
+	}
+	var skipped []string
+	for _, s := range checks {
+		skipped = append(skipped, s.ID())
+	}
+	logger.Warn("skipped checks", "checks", strings.Join(skipped, ","), "reason", reason)
+}
+
+// runCheck queries and evaluates the resources of the check
+func runCheck(ctx context.Context, check Check, env *CheckEnv) ([]Finding, error) {
+	logger.Info("listing resources", "check", check.ID())
+	resources, err := check.Inventory(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	findings, err := check.Evaluate(ctx, env, resources)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("check done", "check", check.ID(), "findings", len(findings))
+	return findings, nil
+}
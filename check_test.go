@@ -0,0 +1,89 @@
+//go:build !release
+// +build !release
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCheckRegistry(t *testing.T) {
+	backend := newFakeVMBackend()
+	ids := map[string]bool{}
+	for _, check := range checkRegistry {
+		if ids[check.ID()] {
+			t.Errorf("duplicate check %s", check.ID())
+		}
+		ids[check.ID()] = true
+
+		env := &CheckEnv{Inventory: backend, Metrics: backend, SubscriptionIDs: []string{"sub"}, Errors: NewEvaluationErrors(false)}
+		findings, err := runCheck(context.Background(), check, env)
+		if err != nil {
+			t.Fatalf("%s: %v", check.ID(), err)
+		}
+		// 検出結果はチェックが宣言したカテゴリに属すること
+		categories := map[string]bool{}
+		for _, c := range check.Categories() {
+			categories[c.ID] = true
+		}
+		for _, f := range findings {
+			if f.Check != check.ID() || !categories[f.Category] {
+				t.Errorf("%s: finding %s has check %s and category %s", check.ID(), f.ResourceName, f.Check, f.Category)
+			}
+		}
+	}
+
+	var names []string
+	for _, c := range checkCommands() {
+		names = append(names, c.Name)
+	}
+	if strings.Join(names, ",") != "disk,vm,hdinsight,all,list-checks" {
+		t.Errorf("commands = %v", names)
+	}
+}
+
+func TestWriteChecks(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeChecks(&b, checkRegistry); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != len(checkRegistry)+1 || !strings.HasPrefix(lines[0], "ID") {
+		t.Fatalf("output = %s", b.String())
+	}
+	if fields := strings.Fields(lines[1]); fields[0] != "disk" || fields[len(fields)-1] != "UnattachedDisks,UnusedVMDisks" {
+		t.Errorf("disk = %q", lines[1])
+	}
+}
+
+func TestSelectChecks(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+		err    string
+	}{
+		{nil, "disk,vm,hdinsight", ""},
+		{[]string{"hdinsight, VM"}, "vm,hdinsight", ""},
+		{[]string{"vm", "vm,disk"}, "disk,vm", ""},
+		{[]string{"vm,sql"}, "", "unknown checks: sql (available: disk, vm, hdinsight)"},
+	}
+	for _, tt := range tests {
+		checks, err := selectChecks(tt.values)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("selectChecks(%v): err = %v", tt.values, err)
+			}
+			continue
+		}
+		var ids []string
+		for _, c := range checks {
+			ids = append(ids, c.ID())
+		}
+		if err != nil || strings.Join(ids, ",") != tt.want {
+			t.Errorf("selectChecks(%v) = %v, %v", tt.values, ids, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/urfave/cli/v2"
+)
+
+// CloudCustom is the name of the cloud given by --cloudEnvironment such as Azure Stack Hub
+const CloudCustom = "custom"
+
+// cloudMetricsBatchEndpoints is endpoints of the metrics batch API of the national clouds
+var cloudMetricsBatchEndpoints = map[string]string{
+	azure.PublicCloud.Name:       metricsBatchEndpoint,
+	azure.ChinaCloud.Name:        "https://{region}.metrics.monitor.azure.cn",
+	azure.USGovernmentCloud.Name: "https://{region}.metrics.monitor.azure.us",
+}
+
+// Cloud is a set of endpoints of Azure Resource Manager, Azure AD and the metrics batch API
+type Cloud struct {
+	Environment azure.Environment
+	// MetricsBatchEndpoint is the endpoint of the metrics batch API with {region} placeholder, or empty when it is not available
+	MetricsBatchEndpoint string
+}
+
+// endpointFlags returns global flags for clouds and custom endpoints
+func endpointFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "cloud",
+			Value:   azure.PublicCloud.Name,
+			Usage:   "Azure cloud (AzurePublicCloud|AzureChinaCloud|AzureUSGovernmentCloud|custom)",
+			EnvVars: []string{"AZURE_ENVIRONMENT"},
+		},
+		&cli.StringFlag{
+			Name:  "cloudEnvironment",
+			Usage: "metadata endpoint of Azure Resource Manager (e.g. https://management.local.azurestack.external) or path to the JSON environment file for --cloud custom",
+		},
+		&cli.StringFlag{
+			Name:  "armEndpoint",
+			Usage: "custom endpoint of Azure Resource Manager (e.g. http://127.0.0.1:8080 of fake-azure)",
+		},
+		&cli.StringFlag{
+			Name:  "metricsBatchEndpoint",
+			Usage: "custom endpoint of the metrics batch API with {region} placeholder. The batch API is not used with --armEndpoint or --cloud custom unless this is specified",
+		},
+	}
+}
+
+// NewCloud returns *Cloud of the name.
+// environment is the metadata endpoint or the path to the environment file of the custom cloud.
+func NewCloud(name string, environment string) (*Cloud, error) {
+	if strings.EqualFold(name, CloudCustom) {
+		if environment == "" {
+			return nil, fmt.Errorf("--cloudEnvironment is required for --cloud %s", CloudCustom)
+		}
+		var env azure.Environment
+		var err error
+		if strings.HasPrefix(environment, "http://") || strings.HasPrefix(environment, "https://") {
+			env, err = azure.EnvironmentFromURL(environment)
+		} else {
+			env, err = azure.EnvironmentFromFile(environment)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the environment of the custom cloud: %v", err)
+		}
+		if env.ResourceManagerEndpoint == "" || env.ActiveDirectoryEndpoint == "" {
+			return nil, fmt.Errorf("resourceManagerEndpoint and activeDirectoryEndpoint are required in the environment of the custom cloud")
+		}
+		return &Cloud{Environment: env}, nil
+	}
+	if environment != "" {
+		return nil, fmt.Errorf("--cloudEnvironment is only for --cloud %s", CloudCustom)
+	}
+
+	env, err := azure.EnvironmentFromName(name)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, ok := cloudMetricsBatchEndpoints[env.Name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cloud: %s", name)
+	}
+	return &Cloud{Environment: env, MetricsBatchEndpoint: endpoint}, nil
+}
+
+// newCloudFromContext returns *Cloud from global flags
+func newCloudFromContext(c *cli.Context) (*Cloud, error) {
+	return NewCloud(c.String("cloud"), c.String("cloudEnvironment"))
+}
+
+// newClientOptions returns *ClientOptions for the cloud from global flags.
+// --armEndpoint and --metricsBatchEndpoint override the endpoints of the cloud.
+func newClientOptions(c *cli.Context, cloud *Cloud) *ClientOptions {
+	options := &ClientOptions{
+		ResourceManagerEndpoint: strings.TrimRight(cloud.Environment.ResourceManagerEndpoint, "/"),
+		MetricsBatchEndpoint:    cloud.MetricsBatchEndpoint,
+	}
+	if v := c.String("armEndpoint"); v != "" {
+		options.ResourceManagerEndpoint = strings.TrimRight(v, "/")
+		options.MetricsBatchEndpoint = ""
+	}
+	if v := c.String("metricsBatchEndpoint"); v != "" {
+		options.MetricsBatchEndpoint = strings.TrimRight(v, "/")
+	}
+	return options
+}
+
+// metricsBatchResource returns the token audience of the metrics batch API, which is the endpoint without the region
+func metricsBatchResource(endpoint string) string {
+	return strings.Replace(endpoint, "{region}.", "", 1)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewCloud(t *testing.T) {
+	tests := []struct {
+		name          string
+		arm           string
+		batch         string
+		batchResource string
+	}{
+		{"AzurePublicCloud", "https://management.azure.com/", "https://{region}.metrics.monitor.azure.com", "https://metrics.monitor.azure.com"},
+		{"azurechinacloud", "https://management.chinacloudapi.cn/", "https://{region}.metrics.monitor.azure.cn", "https://metrics.monitor.azure.cn"},
+		{"AzureUSGovernmentCloud", "https://management.usgovcloudapi.net/", "https://{region}.metrics.monitor.azure.us", "https://metrics.monitor.azure.us"},
+	}
+	for _, tt := range tests {
+		cloud, err := NewCloud(tt.name, "")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if cloud.Environment.ResourceManagerEndpoint != tt.arm {
+			t.Errorf("%s: ResourceManagerEndpoint = %s, want %s", tt.name, cloud.Environment.ResourceManagerEndpoint, tt.arm)
+		}
+		if cloud.MetricsBatchEndpoint != tt.batch {
+			t.Errorf("%s: MetricsBatchEndpoint = %s, want %s", tt.name, cloud.MetricsBatchEndpoint, tt.batch)
+		}
+		if got := metricsBatchResource(cloud.MetricsBatchEndpoint); got != tt.batchResource {
+			t.Errorf("%s: metricsBatchResource = %s, want %s", tt.name, got, tt.batchResource)
+		}
+	}
+
+	for _, name := range []string{"AzureGermanCloud", "unknown", CloudCustom} {
+		if _, err := NewCloud(name, ""); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if _, err := NewCloud("AzurePublicCloud", "environment.json"); err == nil {
+		t.Errorf("--cloudEnvironment without custom: no error")
+	}
+}
+
+func TestNewCloudCustom(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metadata/endpoints" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"galleryEndpoint":"https://portal.local.azurestack.external:30015/","graphEndpoint":"https://graph.windows.net/","authentication":{"loginEndpoint":"https://login.microsoftonline.com/","audiences":["https://management.contoso.onmicrosoft.com/00000000-0000-0000-0000-000000000001"]}}`)
+	}))
+	defer server.Close()
+
+	cloud, err := NewCloud(CloudCustom, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloud.Environment.ResourceManagerEndpoint != server.URL {
+		t.Errorf("ResourceManagerEndpoint = %s", cloud.Environment.ResourceManagerEndpoint)
+	}
+	if cloud.Environment.ActiveDirectoryEndpoint != "https://login.microsoftonline.com/" {
+		t.Errorf("ActiveDirectoryEndpoint = %s", cloud.Environment.ActiveDirectoryEndpoint)
+	}
+	if cloud.Environment.TokenAudience != "https://management.contoso.onmicrosoft.com/00000000-0000-0000-0000-000000000001" {
+		t.Errorf("TokenAudience = %s", cloud.Environment.TokenAudience)
+	}
+	// カスタムクラウドではバッチ API を使わない
+	if cloud.MetricsBatchEndpoint != "" {
+		t.Errorf("MetricsBatchEndpoint = %s", cloud.MetricsBatchEndpoint)
+	}
+
+	dir, err := ioutil.TempDir("", "cloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "environment.json")
+	env := `{"name":"AzureStackHub","resourceManagerEndpoint":"https://management.local.azurestack.external/","activeDirectoryEndpoint":"https://adfs.local.azurestack.external/adfs/","tokenAudience":"https://management.adfs.azurestack.local/"}`
+	if err := ioutil.WriteFile(path, []byte(env), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cloud, err = NewCloud(CloudCustom, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloud.Environment.Name != "AzureStackHub" || cloud.Environment.ResourceManagerEndpoint != "https://management.local.azurestack.external/" {
+		t.Errorf("Environment = %+v", cloud.Environment)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"name":"empty"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCloud(CloudCustom, path); err == nil {
+		t.Errorf("environment without endpoints: no error")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/urfave/cli/v2"
+)
+
+// DefaultResourceGraphConcurrency is the default number of concurrent Resource Graph requests.
+// Resource Graph allows 15 requests per 5 seconds per user, which is much stricter than Azure Monitor.
+const DefaultResourceGraphConcurrency = 4
+
+// headerARMReadsRemaining is the header of Azure Resource Manager which describes the remaining read requests
+const headerARMReadsRemaining = "x-ms-ratelimit-remaining-subscription-reads"
+
+// concurrencyFlags returns global flags for concurrency
+func concurrencyFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:  "concurrency",
+			Value: QueryConcurrency,
+			Usage: "maximum number of concurrent Azure Monitor metrics requests",
+		},
+		&cli.IntFlag{
+			Name:  "resourceGraphConcurrency",
+			Value: DefaultResourceGraphConcurrency,
+			Usage: "maximum number of concurrent Resource Graph requests",
+		},
+		&cli.BoolFlag{
+			Name:  "adaptiveConcurrency",
+			Value: true,
+			Usage: "lower the concurrency when requests are throttled or the quota is running low, and raise it again up to the maximum when healthy",
+		},
+	}
+}
+
+// Limiter limits the number of concurrent requests to an API.
+// In adaptive mode, the limit is halved on throttling and increased by one after a round of healthy responses.
+// A nil *Limiter does not limit.
+type Limiter struct {
+	// Name is the API name shown when the limit changes
+	Name string
+	// Cooldown is the minimum interval of lowering the limit, so that the responses of a burst lower it only once
+	Cooldown time.Duration
+
+	mutex     sync.Mutex
+	max       int
+	limit     int
+	inUse     int
+	adaptive  bool
+	healthy   int
+	decreased time.Time
+	changed   chan struct{}
+}
+
+// NewLimiter returns *Limiter which allows max concurrent requests
+func NewLimiter(name string, max int, adaptive bool) *Limiter {
+	if max < 1 {
+		max = 1
+	}
+	return &Limiter{
+		Name:     name,
+		Cooldown: time.Second,
+		max:      max,
+		limit:    max,
+		adaptive: adaptive,
+		changed:  make(chan struct{}),
+	}
+}
+
+// Max returns the maximum number of concurrent requests
+func (l *Limiter) Max() int {
+	if l == nil {
+		return QueryConcurrency
+	}
+	return l.max
+}
+
+// Limit returns the current number of concurrent requests allowed
+func (l *Limiter) Limit() int {
+	if l == nil {
+		return QueryConcurrency
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limit
+}
+
+// notify wakes up the waiters of Acquire. It must be called with the lock.
+func (l *Limiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Acquire waits for a slot of a request
+func (l *Limiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		l.mutex.Lock()
+		if l.inUse < l.limit {
+			l.inUse++
+			l.mutex.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release returns the slot acquired with Acquire
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.inUse--
+	l.notify()
+}
+
+// Observe adjusts the limit with the response in adaptive mode
+func (l *Limiter) Observe(resp *http.Response) {
+	if l == nil || !l.adaptive || resp == nil {
+		return
+	}
+	if underPressure(resp, l.Limit()) {
+		l.decrease()
+	} else if resp.StatusCode < http.StatusBadRequest {
+		l.increase()
+	}
+}
+
+func (l *Limiter) decrease() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.healthy = 0
+	if l.limit == 1 || time.Since(l.decreased) < l.Cooldown {
+		return
+	}
+	l.limit /= 2
+	if l.limit < 1 {
+		l.limit = 1
+	}
+	l.decreased = time.Now()
+	logger.Warn("concurrency is lowered", "api", l.Name, "concurrency", l.limit)
+}
+
+func (l *Limiter) increase() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.limit >= l.max {
+		return
+	}
+	// 現在の並列数と同じ数の正常なレスポンスが続いたら1つ増やす
+	l.healthy++
+	if l.healthy < l.limit {
+		return
+	}
+	l.healthy = 0
+	l.limit++
+	l.notify()
+	logger.Info("concurrency is raised", "api", l.Name, "concurrency", l.limit)
+}
+
+// underPressure returns true when the response is throttled, or the remaining quota is less than the concurrency
+func underPressure(resp *http.Response, concurrency int) bool {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	for _, h := range []string{headerQuotaRemaining, headerARMReadsRemaining} {
+		v := resp.Header.Get(h)
+		if v == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(v); err == nil && n < concurrency {
+			return true
+		}
+	}
+	return false
+}
+
+// withLimit returns a SendDecorator which sends each attempt in a slot of the limiter
+func withLimit(l *Limiter) autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			if err := l.Acquire(r.Context()); err != nil {
+				return nil, err
+			}
+			defer l.Release()
+			resp, err := s.Do(r)
+			l.Observe(resp)
+			return resp, err
+		})
+	}
+}
+
+// MetricsConcurrency returns the maximum number of concurrent metrics requests
+func (c *Client) MetricsConcurrency() int {
+	return c.MetricsLimiter.Max()
+}
+
+// ResourceGraphConcurrency returns the maximum number of concurrent Resource Graph requests
+func (c *Client) ResourceGraphConcurrency() int {
+	return c.ResourceGraphLimiter.Max()
+}
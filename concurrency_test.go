@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func limiterResponse(status int, header map[string]string) *http.Response {
+	resp := &http.Response{StatusCode: status, Header: http.Header{}}
+	for k, v := range header {
+		resp.Header.Set(k, v)
+	}
+	return resp
+}
+
+func TestLimiterAdaptive(t *testing.T) {
+	l := NewLimiter("test", 8, true)
+	l.Cooldown = 0
+
+	l.Observe(limiterResponse(http.StatusTooManyRequests, nil))
+	if got := l.Limit(); got != 4 {
+		t.Errorf("limit after 429 = %d, want 4", got)
+	}
+	l.Observe(limiterResponse(http.StatusOK, map[string]string{headerQuotaRemaining: "3"}))
+	if got := l.Limit(); got != 2 {
+		t.Errorf("limit after low quota = %d, want 2", got)
+	}
+	l.Observe(limiterResponse(http.StatusTooManyRequests, nil))
+	l.Observe(limiterResponse(http.StatusTooManyRequests, nil))
+	if got := l.Limit(); got != 1 {
+		t.Errorf("limit = %d, want at least 1", got)
+	}
+
+	// 現在の並列数と同じ数の正常なレスポンスで1つ増える
+	for _, want := range []int{2, 2, 3, 3, 3, 4} {
+		l.Observe(limiterResponse(http.StatusOK, map[string]string{headerARMReadsRemaining: "11999"}))
+		if got := l.Limit(); got != want {
+			t.Fatalf("limit = %d, want %d", got, want)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		l.Observe(limiterResponse(http.StatusOK, nil))
+	}
+	if got := l.Limit(); got != 8 {
+		t.Errorf("limit after recovery = %d, want 8", got)
+	}
+
+	// 短時間に続けて制限されても1回だけ下げる
+	l.Cooldown = time.Hour
+	l.decreased = time.Time{}
+	l.Observe(limiterResponse(http.StatusTooManyRequests, nil))
+	l.Observe(limiterResponse(http.StatusTooManyRequests, nil))
+	if got := l.Limit(); got != 4 {
+		t.Errorf("limit after burst of 429 = %d, want 4", got)
+	}
+
+	fixed := NewLimiter("fixed", 8, false)
+	fixed.Observe(limiterResponse(http.StatusTooManyRequests, nil))
+	if got := fixed.Limit(); got != 8 {
+		t.Errorf("limit of non-adaptive limiter = %d, want 8", got)
+	}
+}
+
+func TestLimiterAcquire(t *testing.T) {
+	l := NewLimiter("test", 2, true)
+	l.Cooldown = 0
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := l.Acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		if err := l.Acquire(ctx); err == nil {
+			close(acquired)
+		}
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.Release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("not acquired after release")
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(timeout); err == nil {
+		t.Error("acquired over the limit")
+	}
+}
@@ -2,13 +2,10 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"math"
-	"strings"
-	"sync"
+	"encoding/json"
+	"sort"
 
-	"github.com/urfave/cli/v2"
-	"golang.org/x/sync/semaphore"
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
 )
 
 const (
@@ -19,11 +16,12 @@ const (
 )
 
 type Disk struct {
-	ID            string `json:"id"`
-	ResourceGroup string `json:"resourceGroup"`
-	Name          string `json:"name"`
-	Location      string `json:"location"`
-	Sku           struct {
+	ID             string `json:"id"`
+	SubscriptionID string `json:"subscriptionId"`
+	ResourceGroup  string `json:"resourceGroup"`
+	Name           string `json:"name"`
+	Location       string `json:"location"`
+	Sku            struct {
 		Name string `json:"name"`
 	} `json:"sku"`
 	Properties struct {
@@ -33,227 +31,209 @@ type Disk struct {
 	} `json:"properties"`
 }
 
-func CheckDisk(c *cli.Context) error {
-	client, err := NewClient(c.String("subscriptionID"))
-	if err != nil {
+// Disks is rows of Disk decoded from Resource Graph
+type Disks []Disk
+
+// AppendRow decodes the row into Disk and appends it
+func (r *Disks) AppendRow(row []byte) error {
+	var v Disk
+	if err := json.Unmarshal(row, &v); err != nil {
 		return err
 	}
-	fmt.Println("-------------------  getUnattachedDisks -----------------------")
-	disks, err2 := getUnattachedDisks(client, client.SubscriptionID)
-	if err2 != nil {
-		return err2
-	}
-	//for _, d := range *disks {
-	//fmt.Printf("%s,%s,%s,%s,%d,%s,%s\n", d.ResourceGroup, d.Name, d.Sku.Name, d.Location, d.Properties.DiskSizeGB, d.Properties.DiskState, d.Properties.TimeCreated)
-	//}
-	fmt.Println("---------------------------------------------------------------")
+	*r = append(*r, v)
+	return nil
+}
 
-	fmt.Println("-------------------  getUnusedVMDisks -----------------------")
-	disks2, err3 := getUnusedVMDisks(client, client.SubscriptionID)
-	if err3 != nil {
-		return err3
-	}
-	//for _, d := range *disks2 {
-	//fmt.Printf("%s,%s,%d\n", d.ID, d.Name, d.Properties.DiskSizeGB)
-	//}
-	fmt.Println("---------------------------------------------------------------")
+// Len returns the number of rows
+func (r *Disks) Len() int { return len(*r) }
 
-	m := map[string][]Disk{}
-	m["UnattachedDisks"] = *disks
-	m["UnusedVMDisks"] = *disks2
-	outputToFile(m, "result_disks.html", "disks.tmpl.html")
-	outputToFile(*disks, "result_unattacheddisks.csv", "disks.tmpl.csv")
-	outputToFile(*disks2, "result_unusedvmdisks.csv", "disks.tmpl.csv")
-	return nil
+// Truncate drops the rows after the first n
+func (r *Disks) Truncate(n int) { *r = (*r)[:n] }
+
+// diskCheck reports unattached disks and disks of unused VMs
+type diskCheck struct{}
+
+func (diskCheck) ID() string          { return "disk" }
+func (diskCheck) Description() string { return "Advisor for Disk" }
+func (diskCheck) OutputName() string  { return "result_disks" }
+func (diskCheck) Categories() []Category {
+	return []Category{categoryUnattachedDisks, categoryUnusedVMDisks}
 }
 
-func getUnattachedDisks(client *Client, subscriptionID string) (*[]Disk, error) {
-	project := []ResourceGraphQueryProject{
-		{columnName: "id", queryProperty: "id"},
-		{columnName: "resourceGroup", queryProperty: "resourceGroup"},
-		{columnName: "name", queryProperty: "name"},
-		{columnName: "sku", queryProperty: "sku"},
-		{columnName: "location", queryProperty: "location"},
-		//{columnName: "diskSizeGB", queryProperty: "toint(properties.diskSizeGB)"},
-		//{columnName: "diskState", queryProperty: "tostring(properties.diskState)"},
-		//{columnName: "timeCreated", queryProperty: "properties.timeCreated"},
-		{columnName: "properties", queryProperty: "properties"},
-	}
+// diskInventory is the resources evaluated by the disk check
+type diskInventory struct {
+	unattached []Disk
+	vms        []VM
+}
 
-	qr := buildQueryRequest(
-		`resources | extend disk_tags =  bag_keys(tags) | extend disk_tags_string = tostring(disk_tags) | where type == "microsoft.compute/disks" | where properties.diskState == "Unattached" | where disk_tags_string !contains_cs "ASR-ReplicaDisk"`,
-		client.SubscriptionID,
-		project,
-	)
-	fmt.Printf("Query:%s\n", qr.query)
-	dl, err := FetchResourceGraphData(context.TODO(), client, qr, &Disk{})
+// Inventory returns diskInventory
+func (diskCheck) Inventory(ctx context.Context, env *CheckEnv) (interface{}, error) {
+	unattached, err := getUnattachedDisks(ctx, env.Inventory, env.SubscriptionIDs)
 	if err != nil {
 		return nil, err
 	}
-	var result []Disk
-	for _, d := range dl {
-		result = append(result, *d.(*Disk))
+	vms, err := getVM(ctx, env.Inventory, env.SubscriptionIDs)
+	if err != nil {
+		return nil, err
 	}
-
-	return &result, nil
+	return diskInventory{unattached: *unattached, vms: *vms}, nil
 }
 
-func getUnusedVMDisks(client *Client, subscriptionID string) (*[]Disk, error) {
-	// --------------------------------------------
-	// 仮想マシンの一覧を取得
-	// --------------------------------------------
-	vms, err := getVM(client, subscriptionID)
+func (diskCheck) Evaluate(ctx context.Context, env *CheckEnv, resources interface{}) ([]Finding, error) {
+	inventory := resources.(diskInventory)
+	disks, err := unusedVMDisks(ctx, env.Inventory, env.Metrics, env.SubscriptionIDs, inventory.vms, env.Errors)
 	if err != nil {
 		return nil, err
 	}
-	// --------------------------------------------
-	// 取得した仮想マシンのメトリックを取得
-	// --------------------------------------------
-	mutex := &sync.Mutex{}
-	unusedVMID := []string{}
-
-	var wg sync.WaitGroup
-
-	s := semaphore.NewWeighted(QueryConcurrency)
-	for _, elem := range *vms {
-		wg.Add(1)
-		s.Acquire(context.Background(), 1)
-
-		elem := elem
-
-		go func() error {
-			defer s.Release(1)
-			defer wg.Done()
-
-			fmt.Printf("Processing... get metric:%s\n", elem.Name)
-			input := FetchMetricDataInput{
-				subscriptionID:   subscriptionID,
-				namespace:        "microsoft.compute/virtualmachines",
-				resource:         elem.Name,
-				resourceGroup:    elem.ResourceGroup,
-				aggregation:      "Average",
-				metricNames:      []string{"Percentage CPU"},
-				timeDurationHour: 24 * 30,
-			}
-			metricsList, err := FetchMetricData(context.TODO(), client, input)
-			if err != nil {
-				return err
-			}
-
-			// 1つもメトリックがない VM を使ってない VM とする
-			if len(metricsList["Percentage CPU"]) == 0 {
-				mutex.Lock()
-				unusedVMID = append(unusedVMID, elem.ID)
-				mutex.Unlock()
-			}
-			// テスト用
-			//unusedVMID = append(unusedVMID, elem.ID)
-			return nil
+	findings := append(diskFindings(categoryUnattachedDisks, SeverityMedium, "disk is not attached to any VM", inventory.unattached),
+		diskFindings(categoryUnusedVMDisks, SeverityLow, "disk is attached to a VM which has no Percentage CPU metric in the lookback window", *disks)...)
+	return findings, nil
+}
 
-		}()
+// Categories of the disk check
+var (
+	categoryUnattachedDisks = Category{ID: "UnattachedDisks", Title: "Unattached Disks"}
+	categoryUnusedVMDisks   = Category{ID: "UnusedVMDisks", Title: "Unused VM's Disks"}
+)
 
+// diskFindings returns findings of the disks in the category
+func diskFindings(category Category, severity Severity, reason string, disks []Disk) []Finding {
+	var findings []Finding
+	for _, d := range disks {
+		findings = append(findings, Finding{
+			Check:          "disk",
+			Category:       category.ID,
+			Severity:       severity,
+			ResourceID:     d.ID,
+			ResourceName:   d.Name,
+			SubscriptionID: d.SubscriptionID,
+			ResourceGroup:  d.ResourceGroup,
+			Location:       d.Location,
+			Reason:         reason,
+			Evidence: map[string]interface{}{
+				"DiskState":   d.Properties.DiskState,
+				"DiskSizeGB":  d.Properties.DiskSizeGB,
+				"SkuName":     d.Sku.Name,
+				"TimeCreated": d.Properties.TimeCreated,
+			},
+			Resource: d,
+		})
 	}
+	return findings
+}
 
-	wg.Wait()
+func getUnattachedDisks(ctx context.Context, inventory ResourceInventory, subscriptionIDs []string) (*[]Disk, error) {
+	// ASR のレプリカディスクはタグで除外する
+	query := NewKQLQuery("resources").
+		Extend(Col("disk_tags", "bag_keys(tags)")).
+		Extend(Col("disk_tags_string", "tostring(disk_tags)")).
+		Where(
+			Eq("type", "microsoft.compute/disks"),
+			Eq("properties.diskState", "Unattached"),
+			NotContainsCS("disk_tags_string", "ASR-ReplicaDisk"),
+		).
+		Project(Cols("id", "subscriptionId", "resourceGroup", "name", "sku", "location", "properties")...)
+	qr := buildQueryRequest(query, subscriptionIDs)
+	logger.Debug("querying unattached disks", "query", qr.query)
+	var result []Disk
+	if err := FetchResourceGraphData(ctx, inventory, qr, (*Disks)(&result)); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
 
+// unusedVMDisks returns the managed disks of the VMs which have no CPU metric in the lookback window
+func unusedVMDisks(ctx context.Context, inventory ResourceInventory, metrics MetricsSource, subscriptionIDs []string, vms []VM, errs *EvaluationErrors) (*[]Disk, error) {
 	// --------------------------------------------
-	// 使用していない VM の 管理ディスクのID一覧を取得
+	// 仮想マシンのメトリックを取得
 	// --------------------------------------------
-	project := []ResourceGraphQueryProject{
-		{columnName: "id", queryProperty: "id"},
-		{columnName: "osDisk", queryProperty: "properties.storageProfile.osDisk"},
-		{columnName: "dataDisks", queryProperty: "properties.storageProfile.dataDisks"},
+	unusedVMID := []string{}
+	// vm チェックと同じクエリにし、all で実行した場合にメトリックを共有する
+	query := MetricQuery{
+		MetricNames:  []string{"Percentage CPU"},
+		Aggregations: []string{"Average", "Maximum"},
 	}
-	queryUnusedVMID := strings.ReplaceAll(strings.Join(unusedVMID, `,`), `,`, `","`)
-
-	qr := buildQueryRequest(
-		`resources | where id in~("`+queryUnusedVMID+`")`,
-		subscriptionID,
-		project,
-	)
-
-	type unusedVMIDs struct {
-		ID        string    `json:"id"`
-		OSDisk    OSDisk    `json:"osDisk"`
-		DataDisks DataDisks `json:"dataDisks"`
+	err := FetchTargetMetrics(ctx, metrics, vmMetricTargets(vms), query, errs, func(i int, values map[string][]insights.MetricValue) {
+		if isUnusedVM(values) {
+			unusedVMID = append(unusedVMID, vms[i].ID)
+		}
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	r, errFetchGraphData := FetchResourceGraphData(context.TODO(), client, qr, &unusedVMIDs{})
-	if errFetchGraphData != nil {
-		fmt.Println(qr.query)
-		return nil, cli.NewExitError(fmt.Sprintf("fetch resource graph data failed: %s", errFetchGraphData.Error()), UNKNOWN)
+	if errs.Aborted() {
+		return nil, errs.ExitError()
 	}
+	// 評価は並列に終わるため、クエリが実行ごとに変わらないように並べ替える
+	sort.Strings(unusedVMID)
 
+	// --------------------------------------------
+	// 使用していない VM の 管理ディスクのID一覧を取得
+	// --------------------------------------------
+	vmInput := LookupByIDsInput{
+		subscriptionIDs: subscriptionIDs,
+		ids:             unusedVMID,
+		columns: []KQLColumn{
+			Col("id", "id"),
+			Col("osDisk", "properties.storageProfile.osDisk"),
+			Col("dataDisks", "properties.storageProfile.dataDisks"),
+		},
+	}
+	var refs vmDiskRefs
+	LookupByIDs(ctx, inventory, vmInput, &refs, errs)
 	var unusedManagedDisksID []string
-
-	for _, v := range r {
-		vm := *v.(*unusedVMIDs)
-
+	for _, vm := range refs {
 		unusedManagedDisksID = append(unusedManagedDisksID, vm.OSDisk.ManagedDisk.ID)
 		for _, d := range vm.DataDisks {
 			unusedManagedDisksID = append(unusedManagedDisksID, d.ManagedDisk.ID)
 		}
 	}
+	if errs.Aborted() {
+		return nil, errs.ExitError()
+	}
 
 	// ---------------------------------------------
 	// 管理ディスクをクエリ
 	// ---------------------------------------------
-	diskProject := []ResourceGraphQueryProject{
-		{columnName: "id", queryProperty: "id"},
-		{columnName: "resourceGroup", queryProperty: "resourceGroup"},
-		{columnName: "name", queryProperty: "name"},
-		{columnName: "sku", queryProperty: "sku"},
-		{columnName: "properties", queryProperty: "properties"},
-		{columnName: "location", queryProperty: "location"},
+	// 非管理ディスクは ID が空のため LookupByIDs で除かれる
+	diskInput := LookupByIDsInput{
+		subscriptionIDs: subscriptionIDs,
+		ids:             unusedManagedDisksID,
+		columns:         Cols("id", "subscriptionId", "resourceGroup", "name", "sku", "properties", "location"),
 	}
-
 	var result []Disk
+	LookupByIDs(ctx, inventory, diskInput, (*Disks)(&result), errs)
+	return &result, nil
+}
 
-	mutex2 := &sync.Mutex{}
-	var wg2 sync.WaitGroup
-	s2 := semaphore.NewWeighted(QueryConcurrency)
+// vmDiskRef is managed disks of a VM
+type vmDiskRef struct {
+	ID        string    `json:"id"`
+	OSDisk    OSDisk    `json:"osDisk"`
+	DataDisks DataDisks `json:"dataDisks"`
+}
 
-	// 一度に大量のクエリをすると制限があるため1クエリ当たりのディスク数の最大値を決める
-	const QUERYNUM = 10
-	loopCnt := int(math.Ceil(float64(len(unusedManagedDisksID)) / float64(QUERYNUM)))
-	for i := 0; i < loopCnt; i++ {
-		wg2.Add(1)
-		s2.Acquire(context.Background(), 1)
+// vmDiskRefs is rows of vmDiskRef decoded from Resource Graph
+type vmDiskRefs []vmDiskRef
 
-		_tmp := unusedManagedDisksID[i*QUERYNUM : i*QUERYNUM+QUERYNUM]
-		targetID := []string{}
-		for _, v := range _tmp {
-			if v != "" {
-				targetID = append(targetID, v)
-			}
-		}
-
-		queryMD := strings.ReplaceAll(strings.Join(targetID, `,`), `,`, `","`)
+// AppendRow decodes the row into vmDiskRef and appends it
+func (r *vmDiskRefs) AppendRow(row []byte) error {
+	var v vmDiskRef
+	if err := json.Unmarshal(row, &v); err != nil {
+		return err
+	}
+	*r = append(*r, v)
+	return nil
+}
 
-		qrMD := buildQueryRequest(
-			`resources | where id in~("`+queryMD+`")`,
-			subscriptionID,
-			diskProject,
-		)
+// Len returns the number of rows
+func (r *vmDiskRefs) Len() int { return len(*r) }
 
-		fmt.Printf("Query disk processing: %d/%d\n", i+1, loopCnt)
-		go func() error {
-			defer s2.Release(1)
-			defer wg2.Done()
-			r2, errFetchMDGraphData := FetchResourceGraphData(context.TODO(), client, qrMD, &Disk{})
-			if errFetchMDGraphData != nil {
-				fmt.Println(qr.query)
-				return cli.NewExitError(fmt.Sprintf("fetch resource graph data failed: %s", errFetchMDGraphData.Error()), UNKNOWN)
-			}
+// Truncate drops the rows after the first n
+func (r *vmDiskRefs) Truncate(n int) { *r = (*r)[:n] }
 
-			mutex2.Lock()
-			for _, d := range r2 {
-				result = append(result, *d.(*Disk))
-			}
-			mutex2.Unlock()
-			return nil
-		}()
-	}
-	wg2.Wait()
-	return &result, nil
+// isUnusedVM returns true when the VM has no CPU metric
+func isUnusedVM(metricsList map[string][]insights.MetricValue) bool {
+	// 1つもメトリックがない VM を使ってない VM とする
+	return len(metricsList["Percentage CPU"]) == 0
 }
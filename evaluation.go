@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli/v2"
+)
+
+// EvaluationError is an error occurred while evaluating a resource
+type EvaluationError struct {
+	ResourceID string
+	Name       string
+	Err        error
+}
+
+// Error returns the message of the original error
+func (e EvaluationError) Error() string {
+	return fmt.Sprintf("%s: %v", e.ResourceID, e.Err)
+}
+
+// EvaluationErrors collects errors of resources evaluated concurrently
+type EvaluationErrors struct {
+	mutex        sync.Mutex
+	errors       []EvaluationError
+	recorded     map[string]bool
+	abortOnError bool
+}
+
+// NewEvaluationErrors returns *EvaluationErrors.
+// When abortOnError is true, the run stops at the first error.
+func NewEvaluationErrors(abortOnError bool) *EvaluationErrors {
+	return &EvaluationErrors{abortOnError: abortOnError, recorded: map[string]bool{}}
+}
+
+// Add records the error of the resource.
+// Errors of a resource already recorded are ignored, since checks of a run may evaluate the same resource.
+func (e *EvaluationErrors) Add(resourceID string, name string, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	key := strings.ToLower(resourceID)
+	if e.recorded[key] {
+		return
+	}
+	e.recorded[key] = true
+	e.errors = append(e.errors, EvaluationError{ResourceID: resourceID, Name: name, Err: err})
+}
+
+// Len returns the number of recorded errors
+func (e *EvaluationErrors) Len() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return len(e.errors)
+}
+
+// List returns the recorded errors
+func (e *EvaluationErrors) List() []EvaluationError {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]EvaluationError{}, e.errors...)
+}
+
+// evaluationFlags returns global flags for handling evaluation errors
+func evaluationFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "abortOnError",
+			Usage: "abort the run when a resource could not be evaluated (by default the run completes and reports the resources)",
+		},
+	}
+}
+
+// Aborted returns true when no more resources should be evaluated
+func (e *EvaluationErrors) Aborted() bool {
+	return e.abortOnError && e.Len() > 0
+}
+
+// ExitError returns the error with the exit code of the run.
+// It is nil when all resources were evaluated.
+func (e *EvaluationErrors) ExitError() error {
+	errs := e.List()
+	if len(errs) == 0 {
+		return nil
+	}
+	for _, v := range errs {
+		logger.Warn("could not evaluate", "resourceId", v.ResourceID, "error", v.Err)
+	}
+	if e.abortOnError {
+		return cli.NewExitError(fmt.Sprintf("aborted: %s", errs[0].Error()), UNKNOWN)
+	}
+	return cli.NewExitError(fmt.Sprintf("%d resources could not be evaluated", len(errs)), WARNING)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestEvaluationErrors(t *testing.T) {
+	id := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1"
+	tests := []struct {
+		name         string
+		abortOnError bool
+		ids          []string
+		len          int
+		aborted      bool
+		code         int
+	}{
+		{"no errors", false, nil, 0, false, 0},
+		{"no errors with abortOnError", true, nil, 0, false, 0},
+		{"errors", false, []string{id}, 1, false, WARNING},
+		// チェックをまたいで同じリソースのエラーは1つだけ記録する
+		{"duplicated errors", false, []string{id, id, "/SUBSCRIPTIONS/SUB/resourcegroups/RG/providers/microsoft.compute/virtualmachines/VM1"}, 1, false, WARNING},
+		{"aborted", true, []string{id, "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk1"}, 2, true, UNKNOWN},
+	}
+	for _, tt := range tests {
+		errs := NewEvaluationErrors(tt.abortOnError)
+		for i, id := range tt.ids {
+			errs.Add(id, "name", errors.New("throttled"))
+			// 最初のエラーが残ること
+			if i == 0 && errs.List()[0].ResourceID != id {
+				t.Errorf("%s: recorded = %v", tt.name, errs.List())
+			}
+		}
+		if errs.Len() != tt.len || len(errs.List()) != tt.len {
+			t.Errorf("%s: Len() = %d, want %d", tt.name, errs.Len(), tt.len)
+		}
+		if errs.Aborted() != tt.aborted {
+			t.Errorf("%s: Aborted() = %v", tt.name, errs.Aborted())
+		}
+
+		err := errs.ExitError()
+		if tt.code == 0 {
+			if err != nil {
+				t.Errorf("%s: ExitError() = %v", tt.name, err)
+			}
+			continue
+		}
+		if exit, ok := err.(cli.ExitCoder); !ok || exit.ExitCode() != tt.code {
+			t.Errorf("%s: ExitError() = %v, want exit code %d", tt.name, err, tt.code)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+//go:build !release
+// +build !release
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// FakeBackend is an in-memory ResourceInventory and MetricsSource for tests and demos.
+// Queries are evaluated with the subset of KQL used by the checks.
+type FakeBackend struct {
+	// Resources is rows of the resources table of Resource Graph
+	Resources []map[string]interface{}
+	// Metrics is metric values with the lower-cased resource ID and metric name as hash keys
+	Metrics map[string]map[string][]insights.MetricValue
+	// Definitions is metric definitions with resource type as hash key.
+	// Definitions of the metrics in Metrics are added for the types of the resources.
+	Definitions map[string][]insights.MetricDefinition
+	// MetricErrors is errors returned for the lower-cased resource IDs
+	MetricErrors map[string]error
+	// BatchSize is the number of targets fetched at once (default: 1)
+	BatchSize int
+}
+
+var (
+	_ ResourceInventory = (*FakeBackend)(nil)
+	_ MetricsSource     = (*FakeBackend)(nil)
+)
+
+// QueryResources evaluates the query against the resources in the subscriptions
+func (f *FakeBackend) QueryResources(ctx context.Context, params ResourceGraphQueryRequestInput, rows ResourceGraphRows) (ResourceGraphQueryStats, error) {
+	var resources []map[string]interface{}
+	for _, r := range f.Resources {
+		if len(params.subscriptionIDs) == 0 || containsFold(params.subscriptionIDs, kqlToString(r["subscriptionId"])) {
+			resources = append(resources, r)
+		}
+	}
+	resources, err := fakeQuery(params.query, resources)
+	if err != nil {
+		return ResourceGraphQueryStats{}, err
+	}
+
+	// Resource Graph と同じく JSON の行から読み込む
+	for i, r := range resources {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return ResourceGraphQueryStats{}, err
+		}
+		if err := appendResourceGraphRow(rows, i, b); err != nil {
+			return ResourceGraphQueryStats{}, err
+		}
+	}
+	stats := ResourceGraphQueryStats{TotalRecords: int64(len(resources)), Returned: int64(len(resources))}
+	return stats, nil
+}
+
+// ResourceGraphConcurrency returns DefaultResourceGraphConcurrency
+func (f *FakeBackend) ResourceGraphConcurrency() int {
+	return DefaultResourceGraphConcurrency
+}
+
+// MetricsConcurrency returns QueryConcurrency
+func (f *FakeBackend) MetricsConcurrency() int {
+	return QueryConcurrency
+}
+
+// MetricsBatchSize returns BatchSize
+func (f *FakeBackend) MetricsBatchSize() int {
+	if f.BatchSize < 1 {
+		return 1
+	}
+	return f.BatchSize
+}
+
+// FetchMetrics returns the metrics of the query for the targets
+func (f *FakeBackend) FetchMetrics(ctx context.Context, targets []MetricTarget, query MetricQuery) []TargetMetrics {
+	var results []TargetMetrics
+	for i, t := range targets {
+		if interrupted(ctx) {
+			break
+		}
+		id := strings.ToLower(t.ID)
+		if err, ok := f.MetricErrors[id]; ok {
+			results = append(results, TargetMetrics{Index: i, Err: err})
+			continue
+		}
+		metrics := map[string][]insights.MetricValue{}
+		for _, name := range query.MetricNames {
+			for _, d := range f.Metrics[id][name] {
+				if hasAggregation(d, query.Aggregations) && d.TimeStamp != nil {
+					metrics[name] = append(metrics[name], d)
+				}
+			}
+		}
+		results = append(results, TargetMetrics{Index: i, Metrics: metrics})
+	}
+	return results
+}
+
+// MetricsInterval returns DefaultInterval
+func (f *FakeBackend) MetricsInterval() string {
+	return DefaultInterval
+}
+
+// MetricDefinitions returns the metric definitions of the type of the resource
+func (f *FakeBackend) MetricDefinitions(ctx context.Context, resourceID string) ([]insights.MetricDefinition, error) {
+	t := f.resourceType(resourceID)
+	if t == "" {
+		return nil, fmt.Errorf("resource %s is not found", resourceID)
+	}
+	return f.metricDefinitions(t), nil
+}
+
+// resourceType returns the lower-cased type of the resource, or empty when it does not exist
+func (f *FakeBackend) resourceType(id string) string {
+	for _, r := range f.Resources {
+		if strings.EqualFold(kqlToString(r["id"]), id) {
+			return strings.ToLower(kqlToString(r["type"]))
+		}
+	}
+	return ""
+}
+
+// metricDefinitions returns the definitions of the resource type
+func (f *FakeBackend) metricDefinitions(resourceType string) []insights.MetricDefinition {
+	var result []insights.MetricDefinition
+	defined := map[string]bool{}
+	for t, defs := range f.Definitions {
+		if !strings.EqualFold(t, resourceType) {
+			continue
+		}
+		for _, d := range defs {
+			if d.Name != nil && d.Name.Value != nil {
+				defined[*d.Name.Value] = true
+			}
+			result = append(result, d)
+		}
+	}
+
+	// 定義がないメトリックは時系列データから定義を作る
+	var names []string
+	for id, m := range f.Metrics {
+		if f.resourceType(id) != resourceType {
+			continue
+		}
+		for name := range m {
+			if !defined[name] {
+				defined[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	var grains []string
+	for g := range supportedIntervals {
+		grains = append(grains, g)
+	}
+	sort.Strings(grains)
+	for _, name := range names {
+		var availabilities []insights.MetricAvailability
+		for _, g := range grains {
+			availabilities = append(availabilities, insights.MetricAvailability{TimeGrain: to.StringPtr(g)})
+		}
+		result = append(result, insights.MetricDefinition{
+			Name:                      &insights.LocalizableString{Value: to.StringPtr(name), LocalizedValue: to.StringPtr(name)},
+			Unit:                      insights.UnitUnspecified,
+			PrimaryAggregationType:    insights.Average,
+			SupportedAggregationTypes: &[]insights.AggregationType{insights.None, insights.Average, insights.Count, insights.Minimum, insights.Maximum, insights.Total},
+			MetricAvailabilities:      &availabilities,
+		})
+	}
+	return result
+}
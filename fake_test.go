@@ -0,0 +1,225 @@
+//go:build !release
+// +build !release
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func fakeVM(name string, disks ...string) map[string]interface{} {
+	id := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/" + name
+	var dataDisks []interface{}
+	for _, d := range disks[1:] {
+		dataDisks = append(dataDisks, map[string]interface{}{"managedDisk": map[string]interface{}{"id": fakeDiskID(d)}})
+	}
+	return map[string]interface{}{
+		"id":             id,
+		"type":           "microsoft.compute/virtualmachines",
+		"subscriptionId": "sub",
+		"resourceGroup":  "rg",
+		"name":           name,
+		"location":       "japaneast",
+		"properties": map[string]interface{}{
+			"storageProfile": map[string]interface{}{
+				"osDisk":    map[string]interface{}{"managedDisk": map[string]interface{}{"id": fakeDiskID(disks[0])}},
+				"dataDisks": dataDisks,
+			},
+		},
+	}
+}
+
+func fakeDiskID(name string) string {
+	return "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/" + name
+}
+
+func fakeDisk(name string, state string, tags map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"id":             fakeDiskID(name),
+		"type":           "microsoft.compute/disks",
+		"subscriptionId": "sub",
+		"resourceGroup":  "rg",
+		"name":           name,
+		"location":       "japaneast",
+		"tags":           tags,
+		"sku":            map[string]interface{}{"name": "Premium_LRS"},
+		"properties":     map[string]interface{}{"diskState": state, "diskSizeGB": 128},
+	}
+}
+
+func fakeMetricValues(values ...float64) []insights.MetricValue {
+	var result []insights.MetricValue
+	for _, v := range values {
+		result = append(result, insights.MetricValue{
+			TimeStamp: &date.Time{},
+			Average:   to.Float64Ptr(v),
+			Maximum:   to.Float64Ptr(v * 2),
+			Total:     to.Float64Ptr(v),
+		})
+	}
+	return result
+}
+
+func newFakeVMBackend() *FakeBackend {
+	var disks []string
+	for i := 0; i < 7; i++ {
+		disks = append(disks, fmt.Sprintf("unused-%d", i))
+	}
+	backend := &FakeBackend{
+		Resources: []map[string]interface{}{
+			fakeVM("running", "running-os"),
+			fakeVM("stopped", disks[:4]...),
+			fakeVM("stopped2", disks[4:]...),
+			fakeVM("broken", "broken-os"),
+			fakeDisk("running-os", "Attached", nil),
+			fakeDisk("broken-os", "Attached", nil),
+			fakeDisk("unattached", "Unattached", map[string]interface{}{"env": "dev"}),
+			fakeDisk("replica", "Unattached", map[string]interface{}{"ASR-ReplicaDisk": "true"}),
+		},
+		Metrics: map[string]map[string][]insights.MetricValue{
+			"/subscriptions/sub/resourcegroups/rg/providers/microsoft.compute/virtualmachines/running": {
+				"Percentage CPU": fakeMetricValues(10, 30),
+			},
+		},
+		MetricErrors: map[string]error{
+			"/subscriptions/sub/resourcegroups/rg/providers/microsoft.compute/virtualmachines/broken": fmt.Errorf("throttled"),
+		},
+		BatchSize: 2,
+	}
+	for _, d := range disks {
+		backend.Resources = append(backend.Resources, fakeDisk(d, "Reserved", nil))
+	}
+	return backend
+}
+
+// runTestCheck runs the check against the backend
+func runTestCheck(t *testing.T, check Check, inventory ResourceInventory, metrics MetricsSource, subscriptionIDs []string, errs *EvaluationErrors) []Finding {
+	t.Helper()
+	env := &CheckEnv{Inventory: inventory, Metrics: metrics, SubscriptionIDs: subscriptionIDs, Errors: errs}
+	findings, err := runCheck(context.Background(), check, env)
+	if err != nil {
+		t.Fatalf("%s: %v", check.ID(), err)
+	}
+	return findings
+}
+
+// categoryFindings returns the findings of the category sorted by resource name
+func categoryFindings(findings []Finding, category Category) []Finding {
+	var result []Finding
+	for _, f := range findings {
+		if f.Category == category.ID {
+			result = append(result, f)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ResourceName < result[j].ResourceName })
+	return result
+}
+
+func TestVMCheckWithFake(t *testing.T) {
+	backend := newFakeVMBackend()
+	errs := NewEvaluationErrors(false)
+	vms := categoryFindings(runTestCheck(t, vmCheck{}, backend, backend, []string{"sub"}, errs), categoryRunningVM)
+	if len(vms) != 1 || vms[0].ResourceName != "running" {
+		t.Fatalf("running VMs = %+v", vms)
+	}
+	if vms[0].Evidence["PercentageCPUPerMonth"] != Percentage(20) || vms[0].Evidence["PercentageCPUMAXPerMonth"] != Percentage(60) {
+		t.Errorf("unexpected CPU usage: %+v", vms[0].Evidence)
+	}
+	if errs.Len() != 1 || errs.List()[0].Name != "broken" {
+		t.Errorf("evaluation errors = %v", errs.List())
+	}
+}
+
+func TestDiskCheckWithFake(t *testing.T) {
+	backend := newFakeVMBackend()
+	errs := NewEvaluationErrors(false)
+	findings := runTestCheck(t, diskCheck{}, backend, backend, []string{"sub"}, errs)
+	var names []string
+	for _, f := range categoryFindings(findings, categoryUnusedVMDisks) {
+		names = append(names, f.ResourceName)
+	}
+	if len(names) != 7 || names[0] != "unused-0" || names[6] != "unused-6" {
+		t.Errorf("unused VM disks = %v", names)
+	}
+	if errs.Len() != 1 {
+		t.Errorf("evaluation errors = %v", errs.List())
+	}
+
+	unattached := categoryFindings(findings, categoryUnattachedDisks)
+	if len(unattached) != 1 || unattached[0].ResourceName != "unattached" || unattached[0].Evidence["DiskSizeGB"] != 128 {
+		t.Errorf("unattached disks = %+v", unattached)
+	}
+}
+
+func TestHDInsightCheckWithFake(t *testing.T) {
+	cluster := func(name string) map[string]interface{} {
+		return map[string]interface{}{
+			"id":             "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.HDInsight/clusters/" + name,
+			"type":           "microsoft.hdinsight/clusters",
+			"subscriptionId": "sub",
+			"resourceGroup":  "rg",
+			"name":           name,
+			"location":       "japaneast",
+		}
+	}
+	backend := &FakeBackend{
+		Resources: []map[string]interface{}{cluster("used"), cluster("unused"), fakeDisk("disk", "Unattached", nil)},
+		Metrics: map[string]map[string][]insights.MetricValue{
+			"/subscriptions/sub/resourcegroups/rg/providers/microsoft.hdinsight/clusters/used": {
+				"GatewayRequests": fakeMetricValues(5),
+			},
+		},
+	}
+	errs := NewEvaluationErrors(false)
+	clusters := categoryFindings(runTestCheck(t, hdinsightCheck{}, backend, backend, []string{"sub"}, errs), categoryUnusedHDInsight)
+	if len(clusters) != 1 || clusters[0].ResourceName != "unused" {
+		t.Errorf("unused clusters = %+v", clusters)
+	}
+	if errs.Len() != 0 {
+		t.Errorf("evaluation errors = %v", errs.List())
+	}
+}
+
+func TestFakeQuery(t *testing.T) {
+	rows := []map[string]interface{}{
+		{"id": "A", "name": "a", "properties": map[string]interface{}{"size": 10.0}},
+		{"id": "B", "name": "b\"quoted", "properties": map[string]interface{}{"size": 20.0}},
+	}
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{`resources | where id in~("a", "c")`, []string{"a"}},
+		{`resources | where name == "b\"quoted" or properties.size < 15`, []string{"a", "b\"quoted"}},
+		{`resources | where properties.size >= 15 and id =~ "b"`, []string{"b\"quoted"}},
+		{`resources | where name !contains_cs "quoted" | project name`, []string{"a"}},
+		{`resources | extend s = toint(properties.size) | where s == 20 | project name`, []string{"b\"quoted"}},
+		{`resources | where name == @'b"quoted'`, []string{"b\"quoted"}},
+		{`resources | take 1`, []string{"a"}},
+	}
+	for _, tt := range tests {
+		result, err := fakeQuery(tt.query, rows)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		var names []string
+		for _, r := range result {
+			names = append(names, r["name"].(string))
+		}
+		if fmt.Sprint(names) != fmt.Sprint(tt.want) {
+			t.Errorf("%s = %v, want %v", tt.query, names, tt.want)
+		}
+	}
+
+	if _, err := fakeQuery(`resources | summarize count()`, rows); err == nil {
+		t.Errorf("unsupported operator should be an error")
+	}
+}
@@ -0,0 +1,364 @@
+//go:build !release
+// +build !release
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
+	"github.com/Azure/azure-sdk-for-go/services/resourcegraph/mgmt/2019-04-01/resourcegraph"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// FakeAzureFixture is resources and metrics served by fake-azure
+type FakeAzureFixture struct {
+	// Resources is rows of the resources table of Resource Graph
+	Resources []map[string]interface{} `json:"resources"`
+	// Metrics is metric values with resource ID and metric name as hash keys
+	Metrics map[string]map[string][]insights.MetricValue `json:"metrics"`
+	// MetricDefinitions is metric definitions with resource type as hash key.
+	// Definitions of the metrics in Metrics are added for the types of the resources.
+	MetricDefinitions map[string][]insights.MetricDefinition `json:"metricDefinitions"`
+}
+
+// LoadFakeAzureFixture reads the fixture, which is YAML when the extension is .yaml or .yml and JSON otherwise
+func LoadFakeAzureFixture(path string) (*FakeAzureFixture, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if b, err = yamlToJSON(b); err != nil {
+			return nil, fmt.Errorf("invalid fixture %s: %v", path, err)
+		}
+	}
+	var f FakeAzureFixture
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("invalid fixture %s: %v", path, err)
+	}
+	return &f, nil
+}
+
+// yamlToJSON converts YAML to JSON, so that YAML fixtures have the same fields as JSON ones
+func yamlToJSON(b []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonCompatible(v))
+}
+
+// jsonCompatible replaces the maps decoded by yaml.v2 with map[string]interface{}
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			// 数値などのキーも JSON と同じく文字列として扱う
+			m[fmt.Sprint(k)] = jsonCompatible(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonCompatible(e)
+		}
+	}
+	return v
+}
+
+// Backend returns *FakeBackend which serves the fixture
+func (f *FakeAzureFixture) Backend() *FakeBackend {
+	metrics := map[string]map[string][]insights.MetricValue{}
+	for id, m := range f.Metrics {
+		metrics[strings.ToLower(id)] = m
+	}
+	return &FakeBackend{Resources: f.Resources, Metrics: metrics, Definitions: f.MetricDefinitions}
+}
+
+// fakeAzureHandler emulates the endpoints of Azure Resource Manager used by the checks
+type fakeAzureHandler struct {
+	fixture *FakeAzureFixture
+	backend *FakeBackend
+}
+
+// NewFakeAzureHandler returns http.Handler which emulates Resource Graph, Monitor metrics and metric definitions with the fixture
+func NewFakeAzureHandler(fixture *FakeAzureFixture) http.Handler {
+	return &fakeAzureHandler{fixture: fixture, backend: fixture.Backend()}
+}
+
+func (h *fakeAzureHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.ToLower(r.URL.Path)
+	switch {
+	case r.Method == http.MethodPost && path == "/providers/microsoft.resourcegraph/resources":
+		h.resources(w, r)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/metrics:getbatch"):
+		h.metricsBatch(w, r)
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/providers/microsoft.insights/metrics"):
+		h.metrics(w, r)
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/providers/microsoft.insights/metricdefinitions"):
+		h.metricDefinitions(w, r)
+	case r.Method == http.MethodGet && path == "/subscriptions":
+		h.subscriptions(w, r)
+	default:
+		writeFakeAzureError(w, http.StatusNotFound, "NotFound", fmt.Sprintf("fake-azure does not support %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func writeFakeAzureJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("fake-azure failed to write the response", "error", err)
+	}
+}
+
+func writeFakeAzureError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"code": code, "message": message},
+	})
+}
+
+func (h *fakeAzureHandler) resources(w http.ResponseWriter, r *http.Request) {
+	var req resourcegraph.QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Query == nil {
+		writeFakeAzureError(w, http.StatusBadRequest, "BadRequest", fmt.Sprintf("invalid query request: %v", err))
+		return
+	}
+	params := ResourceGraphQueryRequestInput{query: *req.Query}
+	if req.Subscriptions != nil {
+		params.subscriptionIDs = *req.Subscriptions
+	}
+	var rows rawRows
+	_, err := h.backend.QueryResources(r.Context(), params, &rows)
+	if err != nil {
+		writeFakeAzureError(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+
+	// $skipToken は次のページの先頭の行番号とする
+	offset, top := 0, int(resourceGraphPageSize)
+	if req.Options != nil {
+		if req.Options.SkipToken != nil && *req.Options.SkipToken != "" {
+			if offset, err = strconv.Atoi(*req.Options.SkipToken); err != nil {
+				writeFakeAzureError(w, http.StatusBadRequest, "BadRequest", "invalid $skipToken")
+				return
+			}
+		}
+		if req.Options.Top != nil && int(*req.Options.Top) < top {
+			top = int(*req.Options.Top)
+		}
+	}
+	if offset > len(rows) {
+		offset = len(rows)
+	}
+	end := offset + top
+	if end > len(rows) {
+		end = len(rows)
+	}
+
+	resp := map[string]interface{}{
+		"totalRecords":    len(rows),
+		"count":           end - offset,
+		"resultTruncated": "false",
+		"data":            append(rawRows{}, rows[offset:end]...),
+		"facets":          []interface{}{},
+	}
+	if end < len(rows) {
+		resp["$skipToken"] = strconv.Itoa(end)
+	}
+	writeFakeAzureJSON(w, resp)
+}
+
+// fakeMetricQuery returns MetricQuery from the query parameters
+func fakeMetricQuery(r *http.Request) MetricQuery {
+	var q MetricQuery
+	for _, v := range strings.Split(r.URL.Query().Get("metricnames"), ",") {
+		if v != "" {
+			q.MetricNames = append(q.MetricNames, v)
+		}
+	}
+	for _, v := range strings.Split(r.URL.Query().Get("aggregation"), ",") {
+		if v != "" {
+			q.Aggregations = append(q.Aggregations, v)
+		}
+	}
+	if len(q.Aggregations) == 0 {
+		q.Aggregations = []string{"Average"}
+	}
+	return q
+}
+
+// fakeMetrics returns metrics of the resource in the response format of Azure Monitor
+func (h *fakeAzureHandler) fakeMetrics(r *http.Request, id string, query MetricQuery) ([]insights.Metric, error) {
+	results := h.backend.FetchMetrics(r.Context(), []MetricTarget{{ID: id}}, query)
+	if len(results) == 0 {
+		return nil, r.Context().Err()
+	}
+	if results[0].Err != nil {
+		return nil, results[0].Err
+	}
+	var metrics []insights.Metric
+	for _, name := range query.MetricNames {
+		data := results[0].Metrics[name]
+		if data == nil {
+			data = []insights.MetricValue{}
+		}
+		metrics = append(metrics, insights.Metric{
+			ID:         to.StringPtr(id + "/providers/Microsoft.Insights/metrics/" + name),
+			Type:       to.StringPtr("Microsoft.Insights/metrics"),
+			Name:       &insights.LocalizableString{Value: to.StringPtr(name), LocalizedValue: to.StringPtr(name)},
+			Unit:       insights.UnitUnspecified,
+			Timeseries: &[]insights.TimeSeriesElement{{Data: &data}},
+		})
+	}
+	return metrics, nil
+}
+
+// resourceIDOfMonitorPath returns the resource ID in the path before the provider of Azure Monitor
+func resourceIDOfMonitorPath(path string) string {
+	i := strings.Index(strings.ToLower(path), "/providers/microsoft.insights/")
+	if i >= 0 {
+		path = path[:i]
+	}
+	// SDK は resourceUri の先頭のスラッシュを重ねて送る
+	return "/" + strings.TrimLeft(path, "/")
+}
+
+func (h *fakeAzureHandler) metrics(w http.ResponseWriter, r *http.Request) {
+	id := resourceIDOfMonitorPath(r.URL.Path)
+	if h.backend.resourceType(id) == "" {
+		writeFakeAzureError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("resource %s is not in the fixture", id))
+		return
+	}
+	metrics, err := h.fakeMetrics(r, id, fakeMetricQuery(r))
+	if err != nil {
+		writeFakeAzureError(w, http.StatusInternalServerError, "InternalServerError", err.Error())
+		return
+	}
+	writeFakeAzureJSON(w, insights.Response{
+		Timespan: to.StringPtr(r.URL.Query().Get("timespan")),
+		Interval: to.StringPtr(r.URL.Query().Get("interval")),
+		Value:    &metrics,
+	})
+}
+
+func (h *fakeAzureHandler) metricsBatch(w http.ResponseWriter, r *http.Request) {
+	var req metricsBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeAzureError(w, http.StatusBadRequest, "BadRequest", fmt.Sprintf("invalid batch request: %v", err))
+		return
+	}
+	query := fakeMetricQuery(r)
+	var values []map[string]interface{}
+	for _, id := range req.ResourceIDs {
+		// 存在しないリソースはレスポンスに含めない
+		if h.backend.resourceType(id) == "" {
+			continue
+		}
+		metrics, err := h.fakeMetrics(r, id, query)
+		if err != nil {
+			writeFakeAzureError(w, http.StatusInternalServerError, "InternalServerError", err.Error())
+			return
+		}
+		values = append(values, map[string]interface{}{
+			"resourceid": id,
+			"starttime":  r.URL.Query().Get("starttime"),
+			"endtime":    r.URL.Query().Get("endtime"),
+			"interval":   r.URL.Query().Get("interval"),
+			"namespace":  r.URL.Query().Get("metricnamespace"),
+			"value":      metrics,
+		})
+	}
+	writeFakeAzureJSON(w, map[string]interface{}{"values": values})
+}
+
+func (h *fakeAzureHandler) metricDefinitions(w http.ResponseWriter, r *http.Request) {
+	id := resourceIDOfMonitorPath(r.URL.Path)
+	t := h.backend.resourceType(id)
+	if t == "" {
+		writeFakeAzureError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("resource %s is not in the fixture", id))
+		return
+	}
+	defs := h.backend.metricDefinitions(t)
+	for i := range defs {
+		defs[i].ResourceID = to.StringPtr(id)
+	}
+	writeFakeAzureJSON(w, insights.MetricDefinitionCollection{Value: &defs})
+}
+
+func (h *fakeAzureHandler) subscriptions(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	found := map[string]bool{}
+	for _, res := range h.fixture.Resources {
+		id := kqlToString(res["subscriptionId"])
+		if id != "" && !found[strings.ToLower(id)] {
+			found[strings.ToLower(id)] = true
+			ids = append(ids, id)
+		}
+	}
+	var value []map[string]string
+	for _, id := range ids {
+		value = append(value, map[string]string{
+			"id":             "/subscriptions/" + id,
+			"subscriptionId": id,
+			"displayName":    id,
+			"state":          "Enabled",
+		})
+	}
+	writeFakeAzureJSON(w, map[string]interface{}{"value": value})
+}
+
+// RunFakeAzure serves the fixture until the process is stopped
+func RunFakeAzure(c *cli.Context) error {
+	fixture, err := LoadFakeAzureFixture(c.String("fixture"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), UNKNOWN)
+	}
+	addr := c.String("listen")
+	endpoint := "http://" + addr
+	logger.Info("fake-azure is listening", "endpoint", endpoint, "resources", len(fixture.Resources))
+	logger.Info(fmt.Sprintf("run checks with: --armEndpoint %s --metricsBatchEndpoint %s/{region} --authMethod none", endpoint, endpoint))
+	if err := http.ListenAndServe(addr, NewFakeAzureHandler(fixture)); err != nil {
+		return cli.NewExitError(err.Error(), UNKNOWN)
+	}
+	return nil
+}
+
+// fakeAzureCommands returns the fake-azure command, which is not built with the release tag
+func fakeAzureCommands() []*cli.Command {
+	return []*cli.Command{
+		{
+			Name:   "fake-azure",
+			Usage:  "Serve a fixture of resources and metrics as a local stand-in of Azure",
+			Action: RunFakeAzure,
+			Flags:  fakeAzureFlags(),
+		},
+	}
+}
+
+// fakeAzureFlags returns flags of the fake-azure command
+func fakeAzureFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "fixture",
+			Usage:    "path to the fixture of resources and metrics (YAML with the extension .yaml or .yml, JSON otherwise)",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "listen",
+			Value: "127.0.0.1:8080",
+			Usage: "address to listen on",
+		},
+	}
+}
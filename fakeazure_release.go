@@ -0,0 +1,11 @@
+//go:build release
+// +build release
+
+package main
+
+import "github.com/urfave/cli/v2"
+
+// fakeAzureCommands returns no command, since release builds do not include fake-azure
+func fakeAzureCommands() []*cli.Command {
+	return nil
+}
@@ -0,0 +1,122 @@
+//go:build !release
+// +build !release
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+func TestFakeAzureEndToEnd(t *testing.T) {
+	fixture, err := LoadFakeAzureFixture("sample/fake-azure.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewFakeAzureHandler(fixture))
+	defer server.Close()
+
+	options := &ClientOptions{ResourceManagerEndpoint: server.URL, MetricsBatchEndpoint: server.URL + "/{region}"}
+	subscriptionIDs, err := (&SubscriptionScope{AllSubscriptions: true}).Resolve(context.Background(), autorest.NullAuthorizer{}, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscriptionIDs) != 1 {
+		t.Fatalf("subscriptions = %v", subscriptionIDs)
+	}
+	client := newClient(subscriptionIDs, autorest.NullAuthorizer{}, options)
+	client.MetricsBatchClient = NewMetricsBatchClient(autorest.NullAuthorizer{})
+	client.MetricsBatchClient.Endpoint = options.MetricsBatchEndpoint
+
+	errs := NewEvaluationErrors(true)
+	vms := categoryFindings(runTestCheck(t, vmCheck{}, client, client, subscriptionIDs, errs), categoryRunningVM)
+	if len(vms) != 1 || vms[0].ResourceName != "vm-web" || vms[0].Evidence["PercentageCPUMAXPerMonth"] != Percentage(88) {
+		t.Errorf("running VMs = %+v", vms)
+	}
+
+	// バッチ API を使わない場合も同じ結果になる
+	client.MetricsBatchClient = nil
+	vms = categoryFindings(runTestCheck(t, vmCheck{}, client, client, subscriptionIDs, errs), categoryRunningVM)
+	if len(vms) != 1 || vms[0].ResourceName != "vm-web" {
+		t.Errorf("running VMs without batch = %+v", vms)
+	}
+
+	disks := categoryFindings(runTestCheck(t, diskCheck{}, client, client, subscriptionIDs, errs), categoryUnattachedDisks)
+	if len(disks) != 1 || disks[0].ResourceName != "old-data" {
+		t.Errorf("unattached disks = %+v", disks)
+	}
+
+	clusters := categoryFindings(runTestCheck(t, hdinsightCheck{}, client, client, subscriptionIDs, errs), categoryUnusedHDInsight)
+	if len(clusters) != 1 || clusters[0].ResourceName != "hdi-poc" {
+		t.Errorf("unused clusters = %+v", clusters)
+	}
+
+	resourceID, err := ParseResourceID("/subscriptions/" + subscriptionIDs[0] + "/resourceGroups/rg-app/providers/microsoft.compute/virtualmachines/vm-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defs, err := FetchMetricDefinitions(context.Background(), client, FetchMetricDefinitionsInput{resourceID: resourceID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*defs) != 1 || *(*defs)[0].Name.Value != "Percentage CPU" {
+		t.Errorf("metric definitions = %+v", *defs)
+	}
+	if errs.Len() != 0 {
+		t.Errorf("evaluation errors = %v", errs.List())
+	}
+}
+
+func TestLoadFakeAzureFixtureYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fixture.yml")
+	fixture := `
+resources:
+  - id: /subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1
+    type: microsoft.compute/virtualmachines
+    name: vm1
+    properties:
+      hardwareProfile: {vmSize: Standard_D2s_v3}
+metrics:
+  /subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1:
+    Percentage CPU:
+      - timeStamp: 2020-03-01T00:00:00Z
+        maximum: 88
+`
+	if err := ioutil.WriteFile(path, []byte(fixture), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := LoadFakeAzureFixture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Resources) != 1 || f.Resources[0]["name"] != "vm1" {
+		t.Fatalf("resources = %+v", f.Resources)
+	}
+	// 入れ子のマップも JSON と同じ形で読み込まれること
+	if p, ok := f.Resources[0]["properties"].(map[string]interface{}); !ok || p["hardwareProfile"].(map[string]interface{})["vmSize"] != "Standard_D2s_v3" {
+		t.Errorf("properties = %#v", f.Resources[0]["properties"])
+	}
+	values := f.Metrics["/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1"]["Percentage CPU"]
+	if len(values) != 1 || *values[0].Maximum != 88 || values[0].TimeStamp.Format("2006-01-02") != "2020-03-01" {
+		t.Errorf("metrics = %+v", values)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("resources: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFakeAzureFixture(path); err == nil {
+		t.Error("invalid YAML: no error")
+	}
+}
@@ -0,0 +1,665 @@
+//go:build !release
+// +build !release
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// fakeQuery evaluates the subset of KQL used by the checks against in-memory rows.
+// It supports the resources table, where, extend, project and limit/take.
+func fakeQuery(query string, rows []map[string]interface{}) ([]map[string]interface{}, error) {
+	tokens, err := tokenizeKQL(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var stages [][]kqlToken
+	stage := []kqlToken{}
+	for _, t := range tokens {
+		if t.kind == kqlSymbol && t.text == "|" {
+			stages = append(stages, stage)
+			stage = []kqlToken{}
+			continue
+		}
+		stage = append(stage, t)
+	}
+	stages = append(stages, stage)
+
+	if len(stages[0]) != 1 || !strings.EqualFold(stages[0][0].text, "resources") {
+		return nil, fmt.Errorf("fake query supports only the resources table: %s", query)
+	}
+	for _, s := range stages[1:] {
+		if len(s) == 0 {
+			return nil, fmt.Errorf("empty operator in query: %s", query)
+		}
+		p := &kqlParser{tokens: s[1:]}
+		switch strings.ToLower(s[0].text) {
+		case "where":
+			rows, err = p.where(rows)
+		case "extend":
+			rows, err = p.extend(rows, true)
+		case "project":
+			rows, err = p.extend(rows, false)
+		case "limit", "take":
+			rows, err = p.limit(rows)
+		default:
+			err = fmt.Errorf("fake query does not support the operator: %s", s[0].text)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// kqlToken kinds
+const (
+	kqlIdent = iota
+	kqlString
+	kqlNumber
+	kqlSymbol
+)
+
+type kqlToken struct {
+	kind int
+	text string
+}
+
+// tokenizeKQL splits the query into identifiers, literals and symbols
+func tokenizeKQL(query string) ([]kqlToken, error) {
+	var tokens []kqlToken
+	r := []rune(query)
+	isWord := func(c rune) bool { return c == '_' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c) }
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '@' && i+1 < len(r) && (r[i+1] == '"' || r[i+1] == '\''):
+			// verbatim 文字列はクォートを2つ重ねてエスケープする
+			quote := r[i+1]
+			var sb strings.Builder
+			j := i + 2
+			for ; j < len(r); j++ {
+				if r[j] == quote {
+					if j+1 < len(r) && r[j+1] == quote {
+						sb.WriteRune(quote)
+						j++
+						continue
+					}
+					break
+				}
+				sb.WriteRune(r[j])
+			}
+			if j >= len(r) {
+				return nil, fmt.Errorf("unterminated string literal in query: %s", query)
+			}
+			tokens = append(tokens, kqlToken{kqlString, sb.String()})
+			i = j + 1
+		case c == '"' || c == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(r) && r[j] != c; j++ {
+				if r[j] == '\\' && j+1 < len(r) {
+					j++
+					switch r[j] {
+					case 'n':
+						sb.WriteRune('\n')
+					case 't':
+						sb.WriteRune('\t')
+					case 'r':
+						sb.WriteRune('\r')
+					default:
+						sb.WriteRune(r[j])
+					}
+					continue
+				}
+				sb.WriteRune(r[j])
+			}
+			if j >= len(r) {
+				return nil, fmt.Errorf("unterminated string literal in query: %s", query)
+			}
+			tokens = append(tokens, kqlToken{kqlString, sb.String()})
+			i = j + 1
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(r) && (unicode.IsDigit(r[j]) || r[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, kqlToken{kqlNumber, string(r[i:j])})
+			i = j
+		case c == '!' && i+1 < len(r) && unicode.IsLetter(r[i+1]), unicode.IsLetter(c) || c == '_':
+			// !contains や in~ などの演算子も1つの識別子として扱う
+			j := i + 1
+			for j < len(r) && isWord(r[j]) {
+				j++
+			}
+			if j < len(r) && r[j] == '~' {
+				j++
+			}
+			tokens = append(tokens, kqlToken{kqlIdent, string(r[i:j])})
+			i = j
+		default:
+			two := ""
+			if i+1 < len(r) {
+				two = string(r[i : i+2])
+			}
+			switch two {
+			case "==", "!=", "=~", "!~", "<=", ">=":
+				tokens = append(tokens, kqlToken{kqlSymbol, two})
+				i += 2
+				continue
+			}
+			if !strings.ContainsRune("|(),=<>", c) {
+				return nil, fmt.Errorf("unexpected character %q in query: %s", c, query)
+			}
+			tokens = append(tokens, kqlToken{kqlSymbol, string(c)})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// kqlExpr is an evaluated expression for a row
+type kqlExpr func(row map[string]interface{}) (interface{}, error)
+
+type kqlParser struct {
+	tokens []kqlToken
+	pos    int
+}
+
+func (p *kqlParser) peek() *kqlToken {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *kqlParser) next() (kqlToken, error) {
+	t := p.peek()
+	if t == nil {
+		return kqlToken{}, fmt.Errorf("unexpected end of query")
+	}
+	p.pos++
+	return *t, nil
+}
+
+func (p *kqlParser) expectSymbol(s string) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	if t.kind != kqlSymbol || t.text != s {
+		return fmt.Errorf("expected %q but got %q", s, t.text)
+	}
+	return nil
+}
+
+func (p *kqlParser) isSymbol(s string) bool {
+	t := p.peek()
+	return t != nil && t.kind == kqlSymbol && t.text == s
+}
+
+func (p *kqlParser) isKeyword(s string) bool {
+	t := p.peek()
+	return t != nil && t.kind == kqlIdent && t.text == s
+}
+
+func (p *kqlParser) end() error {
+	if t := p.peek(); t != nil {
+		return fmt.Errorf("unexpected token %q", t.text)
+	}
+	return nil
+}
+
+func (p *kqlParser) where(rows []map[string]interface{}) ([]map[string]interface{}, error) {
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.end(); err != nil {
+		return nil, err
+	}
+	var result []map[string]interface{}
+	for _, row := range rows {
+		v, err := expr(row)
+		if err != nil {
+			return nil, err
+		}
+		if b, _ := v.(bool); b {
+			result = append(result, row)
+		}
+	}
+	return result, nil
+}
+
+// extend evaluates the list of name=expr. project keeps only the listed columns.
+func (p *kqlParser) extend(rows []map[string]interface{}, keep bool) ([]map[string]interface{}, error) {
+	var names []string
+	var exprs []kqlExpr
+	for {
+		t, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if t.kind != kqlIdent {
+			return nil, fmt.Errorf("expected a column name but got %q", t.text)
+		}
+		name := t.text
+		expr := kqlPath(name)
+		if p.isSymbol("=") {
+			p.pos++
+			if expr, err = p.or(); err != nil {
+				return nil, err
+			}
+		}
+		names = append(names, name)
+		exprs = append(exprs, expr)
+		if !p.isSymbol(",") {
+			break
+		}
+		p.pos++
+	}
+	if err := p.end(); err != nil {
+		return nil, err
+	}
+
+	var result []map[string]interface{}
+	for _, row := range rows {
+		r := map[string]interface{}{}
+		if keep {
+			for k, v := range row {
+				r[k] = v
+			}
+		}
+		for i, name := range names {
+			v, err := exprs[i](row)
+			if err != nil {
+				return nil, err
+			}
+			r[name] = v
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+func (p *kqlParser) limit(rows []map[string]interface{}) ([]map[string]interface{}, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(t.text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid limit: %s", t.text)
+	}
+	if err := p.end(); err != nil {
+		return nil, err
+	}
+	if n < len(rows) {
+		rows = rows[:n]
+	}
+	return rows, nil
+}
+
+func (p *kqlParser) or() (kqlExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(row map[string]interface{}) (interface{}, error) {
+			a, err := l(row)
+			if err != nil {
+				return nil, err
+			}
+			if b, _ := a.(bool); b {
+				return true, nil
+			}
+			b, err := right(row)
+			if err != nil {
+				return nil, err
+			}
+			v, _ := b.(bool)
+			return v, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *kqlParser) and() (kqlExpr, error) {
+	left, err := p.comparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		p.pos++
+		right, err := p.comparison()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(row map[string]interface{}) (interface{}, error) {
+			a, err := l(row)
+			if err != nil {
+				return nil, err
+			}
+			if b, _ := a.(bool); !b {
+				return false, nil
+			}
+			b, err := right(row)
+			if err != nil {
+				return nil, err
+			}
+			v, _ := b.(bool)
+			return v, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *kqlParser) comparison() (kqlExpr, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t == nil || (t.kind != kqlSymbol && t.kind != kqlIdent) {
+		return left, nil
+	}
+	op := t.text
+	switch op {
+	case "in", "in~", "!in", "!in~":
+		p.pos++
+		list, err := p.list()
+		if err != nil {
+			return nil, err
+		}
+		return func(row map[string]interface{}) (interface{}, error) {
+			v, err := left(row)
+			if err != nil {
+				return nil, err
+			}
+			found := false
+			for _, e := range list {
+				if kqlEqual(v, e, strings.HasSuffix(op, "~")) {
+					found = true
+					break
+				}
+			}
+			return found != strings.HasPrefix(op, "!"), nil
+		}, nil
+	case "==", "!=", "=~", "!~", "<", ">", "<=", ">=",
+		"contains", "!contains", "contains_cs", "!contains_cs",
+		"startswith", "!startswith", "endswith", "!endswith":
+		p.pos++
+	default:
+		return left, nil
+	}
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return func(row map[string]interface{}) (interface{}, error) {
+		a, err := left(row)
+		if err != nil {
+			return nil, err
+		}
+		b, err := right(row)
+		if err != nil {
+			return nil, err
+		}
+		return kqlCompare(op, a, b)
+	}, nil
+}
+
+// list parses a list of literals like ("a", "b")
+func (p *kqlParser) list() ([]interface{}, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	var list []interface{}
+	for !p.isSymbol(")") {
+		e, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		v, err := e(nil)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		if p.isSymbol(",") {
+			p.pos++
+		}
+	}
+	p.pos++
+	return list, nil
+}
+
+func (p *kqlParser) operand() (kqlExpr, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch t.kind {
+	case kqlString:
+		v := t.text
+		return func(map[string]interface{}) (interface{}, error) { return v, nil }, nil
+	case kqlNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, err
+		}
+		return func(map[string]interface{}) (interface{}, error) { return n, nil }, nil
+	case kqlSymbol:
+		if t.text != "(" {
+			return nil, fmt.Errorf("unexpected token %q", t.text)
+		}
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expectSymbol(")")
+	}
+
+	switch t.text {
+	case "true", "false":
+		v := t.text == "true"
+		return func(map[string]interface{}) (interface{}, error) { return v, nil }, nil
+	}
+	if !p.isSymbol("(") {
+		return kqlPath(t.text), nil
+	}
+	// 関数呼び出し
+	p.pos++
+	var args []kqlExpr
+	for !p.isSymbol(")") {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, e)
+		if p.isSymbol(",") {
+			p.pos++
+		} else if !p.isSymbol(")") {
+			return nil, fmt.Errorf("expected \")\" in arguments of %s", t.text)
+		}
+	}
+	p.pos++
+	f, ok := kqlFunctions[strings.ToLower(t.text)]
+	if !ok {
+		return nil, fmt.Errorf("fake query does not support the function: %s", t.text)
+	}
+	name := t.text
+	return func(row map[string]interface{}) (interface{}, error) {
+		var values []interface{}
+		for _, a := range args {
+			v, err := a(row)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		if len(values) != 1 {
+			return nil, fmt.Errorf("%s takes one argument", name)
+		}
+		return f(values[0]), nil
+	}, nil
+}
+
+// kqlPath returns the expression of a column or a property path like properties.diskState
+func kqlPath(path string) kqlExpr {
+	keys := strings.Split(path, ".")
+	return func(row map[string]interface{}) (interface{}, error) {
+		var v interface{} = row
+		for _, k := range keys {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, nil
+			}
+			v = m[k]
+		}
+		return v, nil
+	}
+}
+
+var kqlFunctions = map[string]func(v interface{}) interface{}{
+	"tostring": func(v interface{}) interface{} { return kqlToString(v) },
+	"tolower":  func(v interface{}) interface{} { return strings.ToLower(kqlToString(v)) },
+	"toupper":  func(v interface{}) interface{} { return strings.ToUpper(kqlToString(v)) },
+	"toint": func(v interface{}) interface{} {
+		if n, ok := kqlNumberValue(v); ok {
+			return int64(n)
+		}
+		return nil
+	},
+	"bag_keys": func(v interface{}) interface{} {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		result := []interface{}{}
+		for _, k := range keys {
+			result = append(result, k)
+		}
+		return result
+	},
+	"isempty":    func(v interface{}) interface{} { return kqlToString(v) == "" },
+	"isnotempty": func(v interface{}) interface{} { return kqlToString(v) != "" },
+}
+
+// kqlToString returns the string representation of the value. Dynamic values are converted to JSON.
+func kqlToString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	if n, ok := kqlNumberValue(v); ok {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+func kqlNumberValue(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return t, true
+	case int:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case json.Number:
+		n, err := t.Float64()
+		return n, err == nil
+	case string:
+		n, err := strconv.ParseFloat(t, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func kqlEqual(a, b interface{}, caseInsensitive bool) bool {
+	if _, ok := a.(string); !ok {
+		if x, ok := kqlNumberValue(a); ok {
+			if y, ok := kqlNumberValue(b); ok {
+				return x == y
+			}
+		}
+	}
+	if caseInsensitive {
+		return strings.EqualFold(kqlToString(a), kqlToString(b))
+	}
+	return kqlToString(a) == kqlToString(b)
+}
+
+func kqlCompare(op string, a, b interface{}) (interface{}, error) {
+	negate := strings.HasPrefix(op, "!") && op != "!=" && op != "!~"
+	base := strings.TrimPrefix(op, "!")
+	sa, sb := kqlToString(a), kqlToString(b)
+	var result bool
+	switch op {
+	case "==":
+		return kqlEqual(a, b, false), nil
+	case "!=":
+		return !kqlEqual(a, b, false), nil
+	case "=~":
+		return kqlEqual(a, b, true), nil
+	case "!~":
+		return !kqlEqual(a, b, true), nil
+	case "<", ">", "<=", ">=":
+		x, ok1 := kqlNumberValue(a)
+		y, ok2 := kqlNumberValue(b)
+		if !ok1 || !ok2 {
+			return false, nil
+		}
+		switch op {
+		case "<":
+			return x < y, nil
+		case ">":
+			return x > y, nil
+		case "<=":
+			return x <= y, nil
+		}
+		return x >= y, nil
+	}
+	switch base {
+	case "contains":
+		result = strings.Contains(strings.ToLower(sa), strings.ToLower(sb))
+	case "contains_cs":
+		result = strings.Contains(sa, sb)
+	case "startswith":
+		result = strings.HasPrefix(strings.ToLower(sa), strings.ToLower(sb))
+	case "endswith":
+		result = strings.HasSuffix(strings.ToLower(sa), strings.ToLower(sb))
+	default:
+		return nil, fmt.Errorf("fake query does not support the operator: %s", op)
+	}
+	return result != negate, nil
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rakyll/statik/fs"
+	"github.com/urfave/cli/v2"
+)
+
+// FindingsSchemaVersion is the version of the JSON output described by tmpl/findings.schema.json.
+// The major version is incremented on incompatible changes, and the minor version only on additive changes such as new fields.
+const FindingsSchemaVersion = "1.0"
+
+// Output formats of the results
+const (
+	// FormatHTML writes the HTML report
+	FormatHTML = "html"
+	// FormatCSV writes the CSV file
+	FormatCSV = "csv"
+	// FormatJSON writes a JSON document of FindingsReport
+	FormatJSON = "json"
+	// FormatNDJSON writes the run, each finding and each evaluation error as a JSON line
+	FormatNDJSON = "ndjson"
+)
+
+// stdoutName is the output name which writes the report to stdout
+const stdoutName = "-"
+
+// outputFlags returns flags for the output.
+// Command flags have no default value so that the global flags are used when they are not set.
+func outputFlags(global bool) []cli.Flag {
+	format := &cli.StringFlag{
+		Name:  "format",
+		Usage: "formats of the results separated by comma (html|csv|json|ndjson). json and ndjson follow the schema printed by the schema command",
+	}
+	dir := &cli.StringFlag{
+		Name:  "output-dir",
+		Usage: "directory where the reports are written, which is created if it does not exist",
+	}
+	name := &cli.StringFlag{
+		Name:  "output-name",
+		Usage: "file name of the reports without extension. {check}, {subscription} and {timestamp} are replaced, and - writes a single format to stdout (default: result_<check> such as result_vms)",
+	}
+	if global {
+		format.Value = FormatHTML + "," + FormatCSV
+		dir.Value = "."
+	}
+	return []cli.Flag{format, dir, name}
+}
+
+// OutputOptions is the formats and the location of the reports
+type OutputOptions struct {
+	Formats []string
+	Dir     string
+	// Name is the file name pattern without extension, or stdoutName
+	Name string
+	// Stdout is where the report is written when Name is stdoutName
+	Stdout io.Writer
+}
+
+// newOutputOptions returns *OutputOptions from flags
+func newOutputOptions(c *cli.Context) (*OutputOptions, error) {
+	opts := &OutputOptions{
+		Dir:    lookupStringFlag(c, "output-dir"),
+		Name:   lookupStringFlag(c, "output-name"),
+		Stdout: c.App.Writer,
+	}
+	found := map[string]bool{}
+	for _, f := range strings.Split(lookupStringFlag(c, "format"), ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" || found[f] {
+			continue
+		}
+		if _, ok := formatRenderers[f]; !ok {
+			return nil, cli.NewExitError(fmt.Sprintf("unsupported format: %s (html|csv|json|ndjson)", f), UNKNOWN)
+		}
+		found[f] = true
+		opts.Formats = append(opts.Formats, f)
+	}
+	if len(opts.Formats) == 0 {
+		return nil, cli.NewExitError("no format is specified (html|csv|json|ndjson)", UNKNOWN)
+	}
+	if opts.Name == stdoutName && len(opts.Formats) > 1 {
+		return nil, cli.NewExitError(fmt.Sprintf("--output-name - writes a single format to stdout, but %s are specified", strings.Join(opts.Formats, ",")), UNKNOWN)
+	}
+	return opts, nil
+}
+
+// fileName returns the path of the report without extension.
+// defaultName is used when no pattern is specified.
+func (o *OutputOptions) fileName(report *FindingsReport, defaultName string) string {
+	name := defaultName
+	if o.Name != "" {
+		subscription := "multiple"
+		if len(report.Run.SubscriptionIDs) == 1 {
+			subscription = report.Run.SubscriptionIDs[0]
+		}
+		name = strings.NewReplacer(
+			"{check}", report.Run.Check,
+			"{subscription}", subscription,
+			"{timestamp}", report.Run.GeneratedAt.Format("20060102T150405Z"),
+		).Replace(o.Name)
+	}
+	return filepath.Join(o.Dir, name)
+}
+
+// RunMetadata is the information of the run in the JSON output
+type RunMetadata struct {
+	Check string `json:"check"`
+	// Checks is the IDs of the checks which ran, such as disk and vm for check all
+	Checks          []string  `json:"checks"`
+	ToolVersion     string    `json:"toolVersion"`
+	GeneratedAt     time.Time `json:"generatedAt"`
+	SubscriptionIDs []string  `json:"subscriptionIds"`
+	Lookback        string    `json:"lookback"`
+	Interval        string    `json:"interval"`
+	// Incomplete is the reason why the run did not complete
+	Incomplete string `json:"incomplete,omitempty"`
+}
+
+// Severity is how much the finding needs attention
+type Severity string
+
+// Severities of findings
+const (
+	// SeverityInfo is a report of usage which needs no action by itself
+	SeverityInfo Severity = "info"
+	// SeverityLow is a resource which may be unused
+	SeverityLow Severity = "low"
+	// SeverityMedium is a resource which is unused
+	SeverityMedium Severity = "medium"
+	// SeverityHigh is an expensive resource which is unused
+	SeverityHigh Severity = "high"
+)
+
+// Category is a list of findings of a check such as unattached disks
+type Category struct {
+	ID string
+	// Title is the heading of the list in the HTML report
+	Title string
+}
+
+// Percentage is a percentage in the evidence, which is written with one decimal in the HTML and CSV
+type Percentage float64
+
+func (p Percentage) String() string {
+	return strconv.FormatFloat(float64(p), 'f', 1, 64)
+}
+
+// EstimatedSavings is the monthly cost which is saved by acting on the finding
+type EstimatedSavings struct {
+	MonthlyAmount float64 `json:"monthlyAmount"`
+	Currency      string  `json:"currency"`
+}
+
+// Finding is a resource reported by a check with the reason and the evidence
+type Finding struct {
+	// Check is the name of the check such as vm
+	Check string `json:"check"`
+	// Category is the ID of Category which the finding belongs to such as UnattachedDisks
+	Category       string   `json:"category"`
+	Severity       Severity `json:"severity"`
+	ResourceID     string   `json:"resourceId"`
+	ResourceName   string   `json:"resourceName"`
+	SubscriptionID string   `json:"subscriptionId"`
+	ResourceGroup  string   `json:"resourceGroup"`
+	Location       string   `json:"location,omitempty"`
+	Reason         string   `json:"reason"`
+	// Evidence is the values computed by the check such as PercentageCPUPerMonth
+	Evidence map[string]interface{} `json:"evidence"`
+	// EstimatedSavings is nil when the check can not estimate the cost
+	EstimatedSavings *EstimatedSavings `json:"estimatedSavings,omitempty"`
+	// Resource is the resource as decoded from Resource Graph such as Disk
+	Resource interface{} `json:"resource,omitempty"`
+}
+
+// EvaluationErrorRecord is a resource which could not be evaluated in the JSON output
+type EvaluationErrorRecord struct {
+	ResourceID string `json:"resourceId"`
+	Name       string `json:"name,omitempty"`
+	Error      string `json:"error"`
+}
+
+// FindingsReport is the results of a check rendered in each format
+type FindingsReport struct {
+	SchemaVersion    string                  `json:"schemaVersion"`
+	Run              RunMetadata             `json:"run"`
+	Findings         []Finding               `json:"findings"`
+	EvaluationErrors []EvaluationErrorRecord `json:"evaluationErrors"`
+
+	// categories is the lists in the HTML report in order, which are shown even when empty
+	categories []Category
+	info       *ReportInfo
+}
+
+// NewFindingsReport returns *FindingsReport of the check with the findings of the categories
+func NewFindingsReport(check string, subscriptionIDs []string, info *ReportInfo, categories []Category, findings []Finding) *FindingsReport {
+	report := &FindingsReport{
+		SchemaVersion: FindingsSchemaVersion,
+		Run: RunMetadata{
+			Check:           check,
+			ToolVersion:     version,
+			GeneratedAt:     time.Now().UTC().Truncate(time.Second),
+			SubscriptionIDs: append([]string{}, subscriptionIDs...),
+			Lookback:        info.MetricWindow.LookbackString(),
+			Interval:        info.MetricWindow.Interval,
+			Incomplete:      info.Incomplete,
+			Checks:          append([]string{}, info.Checks...),
+		},
+		// 結果がない場合も null ではなく空の配列にする
+		Findings:         append([]Finding{}, findings...),
+		EvaluationErrors: []EvaluationErrorRecord{},
+		categories:       categories,
+		info:             info,
+	}
+	if len(report.Run.Checks) == 0 {
+		report.Run.Checks = []string{check}
+	}
+	for _, e := range info.EvaluationErrors {
+		report.EvaluationErrors = append(report.EvaluationErrors, EvaluationErrorRecord{ResourceID: e.ResourceID, Name: e.Name, Error: e.Err.Error()})
+	}
+	return report
+}
+
+// WriteJSON writes the report as an indented JSON document
+func (r *FindingsReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteNDJSON writes the run, each finding and each evaluation error as a line with its type
+func (r *FindingsReport) WriteNDJSON(w io.Writer) error {
+	type runLine struct {
+		SchemaVersion string `json:"schemaVersion"`
+		Type          string `json:"type"`
+		RunMetadata
+	}
+	type findingLine struct {
+		SchemaVersion string `json:"schemaVersion"`
+		Type          string `json:"type"`
+		Finding
+	}
+	type errorLine struct {
+		SchemaVersion string `json:"schemaVersion"`
+		Type          string `json:"type"`
+		EvaluationErrorRecord
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(runLine{r.SchemaVersion, "run", r.Run}); err != nil {
+		return err
+	}
+	for _, f := range r.Findings {
+		if err := enc.Encode(findingLine{r.SchemaVersion, "finding", f}); err != nil {
+			return err
+		}
+	}
+	for _, e := range r.EvaluationErrors {
+		if err := enc.Encode(errorLine{r.SchemaVersion, "evaluationError", e}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findingsTable is findings shown in a table with the evidence as columns
+type findingsTable struct {
+	Category Category
+	// Columns is the keys of the evidence of the findings in alphabetical order
+	Columns  []string
+	Findings []Finding
+	// Savings is true when any finding has EstimatedSavings
+	Savings bool
+}
+
+// newFindingsTable returns findingsTable of the findings
+func newFindingsTable(category Category, findings []Finding) findingsTable {
+	t := findingsTable{Category: category, Findings: findings}
+	found := map[string]bool{}
+	for _, f := range findings {
+		for key := range f.Evidence {
+			if !found[key] {
+				found[key] = true
+				t.Columns = append(t.Columns, key)
+			}
+		}
+		if f.EstimatedSavings != nil {
+			t.Savings = true
+		}
+	}
+	sort.Strings(t.Columns)
+	return t
+}
+
+// tables returns a table of each category, and findings of unknown categories are shown at the end
+func (r *FindingsReport) tables() []findingsTable {
+	var tables []findingsTable
+	known := map[string]bool{}
+	for _, c := range r.categories {
+		known[c.ID] = true
+		var findings []Finding
+		for _, f := range r.Findings {
+			if f.Category == c.ID {
+				findings = append(findings, f)
+			}
+		}
+		tables = append(tables, newFindingsTable(c, findings))
+	}
+	for _, f := range r.Findings {
+		if known[f.Category] {
+			continue
+		}
+		known[f.Category] = true
+		var findings []Finding
+		for _, g := range r.Findings {
+			if g.Category == f.Category {
+				findings = append(findings, g)
+			}
+		}
+		tables = append(tables, newFindingsTable(Category{ID: f.Category, Title: f.Category}, findings))
+	}
+	return tables
+}
+
+// WriteHTML writes the HTML report with a table of each category
+func (r *FindingsReport) WriteHTML(w io.Writer) error {
+	return renderTemplate(w, r.tables(), r.reportInfo(), "findings.tmpl.html")
+}
+
+// WriteCSV writes all findings in a CSV with the evidence of all categories as columns
+func (r *FindingsReport) WriteCSV(w io.Writer) error {
+	return renderTemplate(w, newFindingsTable(Category{}, r.Findings), r.reportInfo(), "findings.tmpl.csv")
+}
+
+func (r *FindingsReport) reportInfo() *ReportInfo {
+	if r.info == nil {
+		return &ReportInfo{}
+	}
+	return r.info
+}
+
+// Renderer writes FindingsReport in a format
+type Renderer struct {
+	// Extension is the extension of the file such as .html
+	Extension string
+	Render    func(r *FindingsReport, w io.Writer) error
+}
+
+// formatRenderers is the renderer of each format
+var formatRenderers = map[string]Renderer{
+	FormatHTML:   {".html", (*FindingsReport).WriteHTML},
+	FormatCSV:    {".csv", (*FindingsReport).WriteCSV},
+	FormatJSON:   {".json", (*FindingsReport).WriteJSON},
+	FormatNDJSON: {".ndjson", (*FindingsReport).WriteNDJSON},
+}
+
+// outputReport writes the report in the formats of the options.
+// The resources which could not be evaluated are written to a CSV unless the formats include them.
+func outputReport(report *FindingsReport, opts *OutputOptions, defaultName string) error {
+	if opts.Name == stdoutName {
+		return formatRenderers[opts.Formats[0]].Render(report, opts.Stdout)
+	}
+
+	name := opts.fileName(report, defaultName)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	errorsCSV := false
+	for _, f := range opts.Formats {
+		r := formatRenderers[f]
+		if err := writeFileAtomic(name+r.Extension, func(w io.Writer) error { return r.Render(report, w) }); err != nil {
+			return err
+		}
+		logger.Info("wrote the report", "path", name+r.Extension)
+		errorsCSV = errorsCSV || f == FormatHTML || f == FormatCSV
+	}
+	if errorsCSV {
+		return outputEvaluationErrors(report.reportInfo().EvaluationErrors, name+"_errors.csv")
+	}
+	return nil
+}
+
+// schemaCommand returns the command to print the JSON schema of the output
+func schemaCommand() *cli.Command {
+	return &cli.Command{
+		Name:   "schema",
+		Usage:  "Print the JSON Schema of the json and ndjson output",
+		Action: PrintSchema,
+	}
+}
+
+// PrintSchema prints the JSON Schema embedded in the binary
+func PrintSchema(c *cli.Context) error {
+	b, err := findingsSchema()
+	if err != nil {
+		return err
+	}
+	_, err = c.App.Writer.Write(b)
+	return err
+}
+
+// findingsSchema returns the JSON Schema of FindingsReport embedded in the binary
+func findingsSchema() ([]byte, error) {
+	statikFs, err := fs.New()
+	if err != nil {
+		return nil, err
+	}
+	f, err := statikFs.Open("/findings.schema.json")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// writeFileAtomic writes the file with write through a temporary file,
+// so that the file is not left half-written when the run is interrupted.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmpFilePath := path + ".tmp"
+	file, err := os.Create(tmpFilePath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFilePath)
+	defer file.Close()
+
+	if err := write(file); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilePath, path)
+}
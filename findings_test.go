@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestFindingsReport() *FindingsReport {
+	vm := VM{ID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1", SubscriptionID: "sub", ResourceGroup: "rg", Name: "vm1", Location: "japaneast"}
+	vm.Properties.HardwareProfile.VMSize = "Standard_D2s_v3"
+	info := &ReportInfo{
+		EvaluationErrors: []EvaluationError{{ResourceID: "/subscriptions/sub/vm2", Name: "vm2", Err: errors.New("throttled")}},
+		MetricWindow:     DefaultMetricWindow,
+	}
+	findings := runningVMFindings([]RunningVM{{VM: vm, PercentageCPUPerMonth: 12.5, PercentageCPUMAXPerMonth: 80}})
+	return NewFindingsReport("vm", []string{"sub"}, info, []Category{categoryRunningVM}, findings)
+}
+
+func TestFindingsReportJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := newTestFindingsReport().WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	// スキーマの必須項目が出力に含まれること
+	b2, err := findingsSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Required    []string `json:"required"`
+		Definitions map[string]struct {
+			Required []string `json:"required"`
+		} `json:"definitions"`
+	}
+	if err := json.Unmarshal(b2, &schema); err != nil {
+		t.Fatalf("invalid schema: %v", err)
+	}
+	objects := map[string]map[string]interface{}{
+		"":                doc,
+		"run":             doc["run"].(map[string]interface{}),
+		"finding":         doc["findings"].([]interface{})[0].(map[string]interface{}),
+		"evaluationError": doc["evaluationErrors"].([]interface{})[0].(map[string]interface{}),
+	}
+	for name, obj := range objects {
+		required := schema.Required
+		if name != "" {
+			required = schema.Definitions[name].Required
+		}
+		for _, key := range required {
+			if _, ok := obj[key]; !ok {
+				t.Errorf("%s does not have %s required by the schema", name, key)
+			}
+		}
+	}
+
+	if doc["schemaVersion"] != FindingsSchemaVersion || objects["run"]["lookback"] != "30d" || objects["run"]["toolVersion"] != version {
+		t.Errorf("run = %v", doc)
+	}
+	evidence := objects["finding"]["evidence"].(map[string]interface{})
+	if evidence["PercentageCPUPerMonth"] != 12.5 || evidence["VMSize"] != "Standard_D2s_v3" {
+		t.Errorf("evidence = %v", evidence)
+	}
+	resource := objects["finding"]["resource"].(map[string]interface{})
+	if objects["finding"]["severity"] != "info" || resource["name"] != "vm1" {
+		t.Errorf("finding = %v", objects["finding"])
+	}
+}
+
+func TestFindingsReportNDJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := newTestFindingsReport().WriteNDJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	want := []string{"run", "finding", "evaluationError"}
+	if len(lines) != len(want) {
+		t.Fatalf("lines = %d, want %d", len(lines), len(want))
+	}
+	for i, line := range lines {
+		var v map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &v); err != nil {
+			t.Fatal(err)
+		}
+		if v["type"] != want[i] || v["schemaVersion"] != FindingsSchemaVersion {
+			t.Errorf("line %d = %s", i, line)
+		}
+	}
+	if !strings.Contains(lines[1], `"resourceId":"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1"`) {
+		t.Errorf("finding line = %s", lines[1])
+	}
+}
+
+func TestOutputReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	report := newTestFindingsReport()
+	report.Run.GeneratedAt = time.Date(2020, 4, 1, 9, 30, 0, 0, time.UTC)
+	opts := &OutputOptions{Formats: []string{FormatJSON, FormatCSV}, Dir: filepath.Join(dir, "reports"), Name: "{subscription}/{check}_{timestamp}"}
+	if err := outputReport(report, opts, "result_vms"); err != nil {
+		t.Fatal(err)
+	}
+	// 指定した形式と評価できなかったリソースの CSV だけが出力されること
+	files, err := filepath.Glob(filepath.Join(dir, "reports", "sub", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f))
+	}
+	if strings.Join(names, ",") != "vm_20200401T093000Z.csv,vm_20200401T093000Z.json,vm_20200401T093000Z_errors.csv" {
+		t.Errorf("files = %v", names)
+	}
+
+	var b bytes.Buffer
+	opts = &OutputOptions{Formats: []string{FormatNDJSON}, Dir: dir, Name: stdoutName, Stdout: &b}
+	if err := outputReport(report, opts, "result_vms"); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(b.String()), "\n"); len(lines) != 3 {
+		t.Errorf("stdout = %s", b.String())
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.ndjson")); len(files) != 0 {
+		t.Errorf("files were written with -: %v", files)
+	}
+
+	opts = &OutputOptions{Dir: "out"}
+	if name := opts.fileName(report, "result_vms"); name != filepath.Join("out", "result_vms") {
+		t.Errorf("default name = %s", name)
+	}
+}
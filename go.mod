@@ -4,8 +4,9 @@ go 1.13
 
 require (
 	github.com/Azure/azure-sdk-for-go v39.1.0+incompatible
-	github.com/Azure/go-autorest/autorest v0.9.5 // indirect
+	github.com/Azure/go-autorest/autorest v0.9.5
 	github.com/Azure/go-autorest/autorest/azure/auth v0.4.2
+	github.com/Azure/go-autorest/autorest/date v0.2.0
 	github.com/Azure/go-autorest/autorest/to v0.3.0
 	github.com/Azure/go-autorest/autorest/validation v0.2.0 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
@@ -13,4 +14,5 @@ require (
 	github.com/urfave/cli/v2 v2.1.1
 	golang.org/x/crypto v0.0.0-20200210222208-86ce3cb69678 // indirect
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
+	gopkg.in/yaml.v2 v2.4.0
 )
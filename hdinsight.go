@@ -2,20 +2,41 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"sync"
+	"strings"
 
-	"github.com/urfave/cli/v2"
-	"golang.org/x/sync/semaphore"
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
 )
 
 type HDInsight struct {
-	ID            string            `json:"id"`
-	ResourceGroup string            `json:"resourceGroup"`
-	Name          string            `json:"name"`
-	Location      string            `json:"location"`
-	Properties    ClusterProperties `json:"properties"`
+	ID             string            `json:"id"`
+	SubscriptionID string            `json:"subscriptionId"`
+	ResourceGroup  string            `json:"resourceGroup"`
+	Name           string            `json:"name"`
+	Location       string            `json:"location"`
+	Properties     ClusterProperties `json:"properties"`
 }
+
+// HDInsights is rows of HDInsight decoded from Resource Graph
+type HDInsights []HDInsight
+
+// AppendRow decodes the row into HDInsight and appends it
+func (r *HDInsights) AppendRow(row []byte) error {
+	var v HDInsight
+	if err := json.Unmarshal(row, &v); err != nil {
+		return err
+	}
+	*r = append(*r, v)
+	return nil
+}
+
+// Len returns the number of rows
+func (r *HDInsights) Len() int { return len(*r) }
+
+// Truncate drops the rows after the first n
+func (r *HDInsights) Truncate(n int) { *r = (*r)[:n] }
+
 type ClusterProperties struct {
 	ClusterDefinition ClusterDefinition `json:"clusterDefinition"`
 	ComputeProfile    ComputeProfile    `json:"computeProfile"`
@@ -35,106 +56,116 @@ type Role struct {
 	TargetInstanceCount int `json:"targetInstanceCount"`
 }
 
-func CheckHDInsight(c *cli.Context) error {
-	client, err := NewClient(c.String("subscriptionID"))
-	if err != nil {
-		return err
-	}
-	fmt.Println("-------------------  getUnusedHDInsight -----------------------")
-	h, err2 := getUnusedCluster(client, client.SubscriptionID)
-	if err2 != nil {
-		return err2
-	}
-	fmt.Println("---------------------------------------------------------------")
+// hdinsightCheck reports HDInsight clusters which have no gateway request
+type hdinsightCheck struct{}
 
-	outputToFile(map[string][]HDInsight{"UnusedHDInsight": *h}, "result_hdinsight.html", "hdinsights.tmpl.html")
-	outputToFile(*h, "result_hdinsight.csv", "hdinsights.tmpl.csv")
-	return nil
-}
+func (hdinsightCheck) ID() string             { return "hdinsight" }
+func (hdinsightCheck) Description() string    { return "Advisor for HDInsight" }
+func (hdinsightCheck) OutputName() string     { return "result_hdinsight" }
+func (hdinsightCheck) Categories() []Category { return []Category{categoryUnusedHDInsight} }
 
-func getCluster(client *Client, subscriptionID string) (*[]HDInsight, error) {
-	project := []ResourceGraphQueryProject{
-		{columnName: "id", queryProperty: "id"},
-		{columnName: "resourceGroup", queryProperty: "resourceGroup"},
-		{columnName: "name", queryProperty: "name"},
-		{columnName: "location", queryProperty: "location"},
-		{columnName: "properties", queryProperty: "properties"},
+// Inventory returns []HDInsight
+func (hdinsightCheck) Inventory(ctx context.Context, env *CheckEnv) (interface{}, error) {
+	clusters, err := getCluster(ctx, env.Inventory, env.SubscriptionIDs)
+	if err != nil {
+		return nil, err
 	}
+	return *clusters, nil
+}
 
-	qr := buildQueryRequest(
-		`resources | where type =~ "microsoft.hdinsight/clusters"`,
-		subscriptionID,
-		project,
-	)
-
-	r, err := FetchResourceGraphData(context.TODO(), client, qr, &HDInsight{})
+func (hdinsightCheck) Evaluate(ctx context.Context, env *CheckEnv, resources interface{}) ([]Finding, error) {
+	clusters, err := evaluateClusters(ctx, env.Metrics, resources.([]HDInsight), env.Errors)
 	if err != nil {
-		fmt.Println(qr.query)
 		return nil, err
 	}
+	return hdinsightFindings(*clusters), nil
+}
+
+// categoryUnusedHDInsight is the category of the hdinsight check
+var categoryUnusedHDInsight = Category{ID: "UnusedHDInsight", Title: "Unused HDInsight"}
+
+func getCluster(ctx context.Context, inventory ResourceInventory, subscriptionIDs []string) (*[]HDInsight, error) {
+	query := NewKQLQuery("resources").
+		Where(EqFold("type", "microsoft.hdinsight/clusters")).
+		Project(Cols("id", "subscriptionId", "resourceGroup", "name", "location", "properties")...)
+	qr := buildQueryRequest(query, subscriptionIDs)
+
 	var result []HDInsight
-	for _, d := range r {
-		h := *d.(*HDInsight)
-		result = append(result, h)
+	if err := FetchResourceGraphData(ctx, inventory, qr, (*HDInsights)(&result)); err != nil {
+		logger.Error("failed to query HDInsight clusters", "query", qr.query)
+		return nil, err
 	}
 
 	return &result, nil
 }
-func getUnusedCluster(client *Client, subscriptionID string) (*[]HDInsight, error) {
 
+// evaluateClusters returns the clusters which have no gateway request in the lookback window
+func evaluateClusters(ctx context.Context, metrics MetricsSource, clusters []HDInsight, errs *EvaluationErrors) (*[]HDInsight, error) {
 	// --------------------------------------------
-	// HDInsight の一覧を取得
+	// HDInsight のメトリックを取得
 	// --------------------------------------------
-	clusters, err := getCluster(client, subscriptionID)
+	var unusedHDInsight []HDInsight
+	var targets []MetricTarget
+	for _, elem := range clusters {
+		targets = append(targets, MetricTarget{
+			ID:       elem.ID,
+			Name:     elem.Name,
+			Location: elem.Location,
+		})
+	}
+	query := MetricQuery{
+		MetricNames:  []string{"GatewayRequests"},
+		Aggregations: []string{"Total"},
+	}
+	err := FetchTargetMetrics(ctx, metrics, targets, query, errs, func(i int, values map[string][]insights.MetricValue) {
+		if isUnusedCluster(values) {
+			unusedHDInsight = append(unusedHDInsight, clusters[i])
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
-	// --------------------------------------------
-	// 取得した HDInsight のメトリックを取得
-	// --------------------------------------------
-	var unusedHDInsight []HDInsight
 
-	var wg sync.WaitGroup
-	mutex := &sync.Mutex{}
-
-	s := semaphore.NewWeighted(QueryConcurrency)
-
-	for _, elem := range *clusters {
-		elem := elem
-		wg.Add(1)
-		s.Acquire(context.Background(), 1)
-
-		go func() error {
-			defer s.Release(1)
-			defer wg.Done()
-			// 過去1か月1つも Gateway Requests がないクラスタ
-			input := FetchMetricDataInput{
-				subscriptionID:   subscriptionID,
-				namespace:        "microsoft.hdinsight/clusters",
-				resource:         elem.Name,
-				resourceGroup:    elem.ResourceGroup,
-				aggregation:      "Total",
-				metricNames:      []string{"GatewayRequests"},
-				timeDurationHour: 24 * 30,
-			}
-			fmt.Printf("Processing... get metric:%s\n", elem.Name)
-			metricsList, err := FetchMetricData(context.TODO(), client, input)
-			if err != nil {
-				return err
-			}
-
-			// Gateway Requests があるクラスタは無視
-			if len(metricsList["GatewayRequests"]) > 0 {
-				return nil
-			}
-
-			mutex.Lock()
-			unusedHDInsight = append(unusedHDInsight, elem)
-			mutex.Unlock()
-			return nil
-		}()
+	return &unusedHDInsight, nil
+}
+
+// hdinsightFindings returns findings of the unused clusters
+func hdinsightFindings(clusters []HDInsight) []Finding {
+	var findings []Finding
+	for _, h := range clusters {
+		findings = append(findings, Finding{
+			Check:          "hdinsight",
+			Category:       categoryUnusedHDInsight.ID,
+			Severity:       SeverityHigh,
+			ResourceID:     h.ID,
+			ResourceName:   h.Name,
+			SubscriptionID: h.SubscriptionID,
+			ResourceGroup:  h.ResourceGroup,
+			Location:       h.Location,
+			Reason:         "cluster has no gateway request in the lookback window",
+			Evidence: map[string]interface{}{
+				"GatewayRequests": 0,
+				"Kind":            h.Properties.ClusterDefinition.Kind,
+				"Nodes":           clusterNodes(h),
+				"CreatedDate":     h.Properties.CreatedDate,
+			},
+			Resource: h,
+		})
 	}
-	wg.Wait()
+	return findings
+}
 
-	return &unusedHDInsight, nil
+// clusterNodes returns the roles of the cluster such as headnode: Standard_D12_v2 x 2
+func clusterNodes(h HDInsight) string {
+	var nodes []string
+	for _, r := range h.Properties.ComputeProfile.Roles {
+		nodes = append(nodes, fmt.Sprintf("%s: %s x %d", r.Name, r.HardwareProfile.VMSize, r.TargetInstanceCount))
+	}
+	return strings.Join(nodes, ", ")
+}
+
+// isUnusedCluster returns true when the cluster has no gateway request
+func isUnusedCluster(metricsList map[string][]insights.MetricValue) bool {
+	// 期間内に1つも Gateway Requests がないクラスタ
+	return len(metricsList["GatewayRequests"]) == 0
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// KQLExpr is a KQL expression such as a where condition.
+// Columns and functions are written in the code, and values are escaped as literals.
+type KQLExpr string
+
+// KQLColumn is a column of project or extend
+type KQLColumn struct {
+	Name string
+	Expr KQLExpr
+}
+
+// Col returns KQLColumn of the expression with the name
+func Col(name string, expr string) KQLColumn {
+	return KQLColumn{Name: name, Expr: KQLExpr(expr)}
+}
+
+// Cols returns KQLColumn of the columns as they are, such as project id, name
+func Cols(names ...string) []KQLColumn {
+	var columns []KQLColumn
+	for _, name := range names {
+		columns = append(columns, KQLColumn{Name: name})
+	}
+	return columns
+}
+
+func (c KQLColumn) String() string {
+	if c.Expr == "" || string(c.Expr) == c.Name {
+		return c.Name
+	}
+	return c.Name + "=" + string(c.Expr)
+}
+
+// KQLQuery is a Resource Graph query built from a table and operators
+type KQLQuery struct {
+	table     string
+	operators []string
+}
+
+// NewKQLQuery returns *KQLQuery of the table such as resources
+func NewKQLQuery(table string) *KQLQuery {
+	return &KQLQuery{table: table}
+}
+
+func (q *KQLQuery) add(operator string) *KQLQuery {
+	q.operators = append(q.operators, operator)
+	return q
+}
+
+// Where filters rows with the conditions joined with and.
+// The query is not changed when no condition is given.
+func (q *KQLQuery) Where(conditions ...KQLExpr) *KQLQuery {
+	if len(conditions) == 0 {
+		return q
+	}
+	return q.add("where " + string(And(conditions...)))
+}
+
+// Extend adds the columns
+func (q *KQLQuery) Extend(columns ...KQLColumn) *KQLQuery {
+	return q.add("extend " + joinColumns(columns))
+}
+
+// Project selects the columns
+func (q *KQLQuery) Project(columns ...KQLColumn) *KQLQuery {
+	return q.add("project " + joinColumns(columns))
+}
+
+// Take limits the number of rows
+func (q *KQLQuery) Take(n int) *KQLQuery {
+	return q.add(fmt.Sprintf("take %d", n))
+}
+
+// String returns the query text
+func (q *KQLQuery) String() string {
+	return strings.Join(append([]string{q.table}, q.operators...), " | ")
+}
+
+func joinColumns(columns []KQLColumn) string {
+	var list []string
+	for _, c := range columns {
+		list = append(list, c.String())
+	}
+	return strings.Join(list, ", ")
+}
+
+// KQLString returns the string literal of the value with escaping quotes, backslashes and control characters
+func KQLString(v string) KQLExpr {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range v {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return KQLExpr(sb.String())
+}
+
+// Eq returns column == "value" (case-sensitive)
+func Eq(column string, value string) KQLExpr {
+	return KQLExpr(column + " == " + string(KQLString(value)))
+}
+
+// EqFold returns column =~ "value" (case-insensitive)
+func EqFold(column string, value string) KQLExpr {
+	return KQLExpr(column + " =~ " + string(KQLString(value)))
+}
+
+// InFold returns column in~ ("value1", "value2", ...) (case-insensitive).
+// It is false when values is empty because KQL does not accept an empty list.
+func InFold(column string, values []string) KQLExpr {
+	if len(values) == 0 {
+		return "false"
+	}
+	var list []string
+	for _, v := range values {
+		list = append(list, string(KQLString(v)))
+	}
+	return KQLExpr(column + " in~ (" + strings.Join(list, ", ") + ")")
+}
+
+// NotContainsCS returns column !contains_cs "value"
+func NotContainsCS(column string, value string) KQLExpr {
+	return KQLExpr(column + " !contains_cs " + string(KQLString(value)))
+}
+
+// And joins the conditions with and.
+// It is true when no condition is given.
+func And(conditions ...KQLExpr) KQLExpr {
+	switch len(conditions) {
+	case 0:
+		return "true"
+	case 1:
+		return conditions[0]
+	}
+	var list []string
+	for _, c := range conditions {
+		list = append(list, "("+string(c)+")")
+	}
+	return KQLExpr(strings.Join(list, " and "))
+}
+
+// Or joins the conditions with or.
+// It is false when no condition is given.
+func Or(conditions ...KQLExpr) KQLExpr {
+	switch len(conditions) {
+	case 0:
+		return "false"
+	case 1:
+		return conditions[0]
+	}
+	var list []string
+	for _, c := range conditions {
+		list = append(list, "("+string(c)+")")
+	}
+	return KQLExpr(strings.Join(list, " or "))
+}
@@ -0,0 +1,88 @@
+//go:build !release
+// +build !release
+
+package main
+
+import "testing"
+
+func TestKQLQuery(t *testing.T) {
+	tests := []struct {
+		query *KQLQuery
+		want  string
+	}{
+		{
+			NewKQLQuery("resources").
+				Where(EqFold("type", "microsoft.compute/virtualmachines")).
+				Project(Cols("id", "name")...),
+			`resources | where type =~ "microsoft.compute/virtualmachines" | project id, name`,
+		},
+		{
+			NewKQLQuery("resources").
+				Extend(Col("disk_tags", "bag_keys(tags)")).
+				Where(Eq("type", "microsoft.compute/disks"), NotContainsCS("disk_tags", "ASR-ReplicaDisk")).
+				Project(Col("id", "id"), Col("osDisk", "properties.storageProfile.osDisk")),
+			`resources | extend disk_tags=bag_keys(tags) | where (type == "microsoft.compute/disks") and (disk_tags !contains_cs "ASR-ReplicaDisk") | project id, osDisk=properties.storageProfile.osDisk`,
+		},
+		{
+			NewKQLQuery("resources").
+				Where(InFold("id", []string{"/subscriptions/1/disks/a", `/subscriptions/1/disks/b"c`})).
+				Take(10),
+			`resources | where id in~ ("/subscriptions/1/disks/a", "/subscriptions/1/disks/b\"c") | take 10`,
+		},
+		{
+			NewKQLQuery("resources").Where(InFold("id", nil)),
+			`resources | where false`,
+		},
+		{
+			NewKQLQuery("resources").Where().Take(1),
+			`resources | take 1`,
+		},
+		{
+			NewKQLQuery("resources").Where(And(), Or()),
+			`resources | where (true) and (false)`,
+		},
+		{
+			NewKQLQuery("resources").
+				Where(Or(EqFold("type", "a"), EqFold("type", "b"))).
+				Project(Cols("type", "location")...),
+			`resources | where (type =~ "a") or (type =~ "b") | project type, location`,
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.query.String(); got != tt.want {
+			t.Errorf("query = %s\nwant %s", got, tt.want)
+		}
+	}
+}
+
+func TestKQLString(t *testing.T) {
+	tests := []struct {
+		value string
+		want  KQLExpr
+	}{
+		{`abc`, `"abc"`},
+		{`a"b`, `"a\"b"`},
+		{`a\b`, `"a\\b"`},
+		{"a\nb\tc", `"a\nb\tc"`},
+		{`ディスク'1`, `"ディスク'1"`},
+	}
+	for _, tt := range tests {
+		if got := KQLString(tt.value); got != tt.want {
+			t.Errorf("KQLString(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+
+	// エスケープした値がそのまま比較されること
+	rows := []map[string]interface{}{
+		{"id": `/subscriptions/1/disks/quote"d\disk`},
+		{"id": "/subscriptions/1/disks/other"},
+	}
+	q := NewKQLQuery("resources").Where(InFold("id", []string{`/SUBSCRIPTIONS/1/disks/quote"d\disk`}))
+	result, err := fakeQuery(q.String(), rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 || result[0]["id"] != rows[0]["id"] {
+		t.Errorf("result = %v", result)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// LogLevel is the severity of a log entry
+type LogLevel int
+
+// Log levels
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogLevelDebug: "debug",
+	LogLevelInfo:  "info",
+	LogLevelWarn:  "warn",
+	LogLevelError: "error",
+}
+
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+// parseLogLevel parses debug, info, warn or error
+func parseLogLevel(s string) (LogLevel, error) {
+	for l, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return LogLevelInfo, fmt.Errorf("invalid log level: %s (debug|info|warn|error)", s)
+}
+
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Logger writes leveled log entries with key-value fields.
+// Entries are written line by line so that entries of goroutines are not interleaved.
+type Logger struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	level  LogLevel
+	format string
+	now    func() time.Time
+}
+
+// NewLogger returns *Logger which writes entries of the level or higher to out
+func NewLogger(out io.Writer, level LogLevel, format string) *Logger {
+	return &Logger{out: out, level: level, format: format, now: time.Now}
+}
+
+// logger is the logger of the process. Logs go to stderr so that stdout can be used for output.
+var logger = NewLogger(os.Stderr, LogLevelInfo, LogFormatText)
+
+// logFlags returns global flags for logging
+func logFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "log-level",
+			Value: LogLevelInfo.String(),
+			Usage: "minimum level of logs (debug|info|warn|error). debug shows each query and request",
+		},
+		&cli.StringFlag{
+			Name:  "log-format",
+			Value: LogFormatText,
+			Usage: "format of logs written to stderr (text|json)",
+		},
+	}
+}
+
+// configureLogger configures logger with global flags
+func configureLogger(c *cli.Context) error {
+	level, err := parseLogLevel(c.String("log-level"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), UNKNOWN)
+	}
+	format := c.String("log-format")
+	if format != LogFormatText && format != LogFormatJSON {
+		return cli.NewExitError(fmt.Sprintf("invalid log format: %s (text|json)", format), UNKNOWN)
+	}
+	logger = NewLogger(os.Stderr, level, format)
+	return nil
+}
+
+// Debug logs the message with fields given as key-value pairs
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LogLevelDebug, msg, kv)
+}
+
+// Info logs the message with fields given as key-value pairs
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LogLevelInfo, msg, kv)
+}
+
+// Warn logs the message with fields given as key-value pairs
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LogLevelWarn, msg, kv)
+}
+
+// Error logs the message with fields given as key-value pairs
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LogLevelError, msg, kv)
+}
+
+func (l *Logger) log(level LogLevel, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+	fields := map[string]interface{}{}
+	var keys []string
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		var v interface{} = "(missing)"
+		if i+1 < len(kv) {
+			v = kv[i+1]
+		}
+		// エラーや時間は JSON でも文字列として出力する
+		switch vv := v.(type) {
+		case error:
+			v = vv.Error()
+		case time.Duration:
+			v = vv.String()
+		case fmt.Stringer:
+			v = vv.String()
+		}
+		if _, ok := fields[key]; !ok {
+			keys = append(keys, key)
+		}
+		fields[key] = v
+	}
+
+	now := l.now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	var line string
+	if l.format == LogFormatJSON {
+		fields["time"] = now
+		fields["level"] = level.String()
+		fields["msg"] = msg
+		b, err := json.Marshal(fields)
+		if err != nil {
+			b, _ = json.Marshal(map[string]string{"time": now, "level": level.String(), "msg": msg, "logError": err.Error()})
+		}
+		line = string(b)
+	} else {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%s %-5s %s", now, strings.ToUpper(level.String()), msg)
+		for _, k := range keys {
+			fmt.Fprintf(&sb, " %s=%s", k, logfmtValue(fields[k]))
+		}
+		line = sb.String()
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	fmt.Fprintln(l.out, line)
+}
+
+// logfmtValue quotes the value when it has spaces or quotes
+func logfmtValue(v interface{}) string {
+	var s string
+	switch vv := v.(type) {
+	case string:
+		s = vv
+	case []string:
+		s = strings.Join(vv, ",")
+	default:
+		s = fmt.Sprint(vv)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// progressInterval is the minimum interval of progress logs
+const progressInterval = 5 * time.Second
+
+// Progress reports the number of evaluated resources and ETA to logger.
+// It is shared by the goroutines of a step and logs at most every progressInterval.
+type Progress struct {
+	mutex  sync.Mutex
+	name   string
+	total  int
+	done   int
+	start  time.Time
+	logged time.Time
+}
+
+// NewProgress returns *Progress of the step which evaluates total resources
+func NewProgress(name string, total int) *Progress {
+	now := time.Now()
+	logger.Info(name, "done", 0, "total", total)
+	return &Progress{name: name, total: total, start: now, logged: now}
+}
+
+// Add adds n to the number of evaluated resources
+func (p *Progress) Add(n int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.done += n
+	now := time.Now()
+	if p.done < p.total && now.Sub(p.logged) < progressInterval {
+		return
+	}
+	p.logged = now
+	kv := []interface{}{"done", p.done, "total", p.total}
+	if p.done < p.total {
+		kv = append(kv, "eta", p.eta(now))
+	} else {
+		kv = append(kv, "elapsed", now.Sub(p.start).Round(time.Second))
+	}
+	logger.Info(p.name, kv...)
+}
+
+// eta estimates the remaining time from the average time per resource
+func (p *Progress) eta(now time.Time) time.Duration {
+	if p.done == 0 {
+		return 0
+	}
+	elapsed := now.Sub(p.start)
+	return (elapsed / time.Duration(p.done) * time.Duration(p.total-p.done)).Round(time.Second)
+}
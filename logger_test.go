@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	now := func() time.Time { return time.Date(2020, 3, 15, 1, 2, 3, 0, time.UTC) }
+	id := "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1"
+
+	var text bytes.Buffer
+	l := NewLogger(&text, LogLevelInfo, LogFormatText)
+	l.now = now
+	l.Debug("fetching metrics", "resourceId", id)
+	l.Warn("could not evaluate", "resourceId", id, "error", errors.New("not found"), "eta", 90*time.Second)
+	want := "2020-03-15T01:02:03.000Z WARN  could not evaluate resourceId=" + id + ` error="not found" eta=1m30s` + "\n"
+	if text.String() != want {
+		t.Errorf("text log = %q, want %q", text.String(), want)
+	}
+
+	var js bytes.Buffer
+	l = NewLogger(&js, LogLevelDebug, LogFormatJSON)
+	l.now = now
+	l.Debug("fetching metrics", "resourceId", id, "resources", 2)
+	var entry map[string]interface{}
+	if err := json.Unmarshal(js.Bytes(), &entry); err != nil {
+		t.Fatalf("json log %q: %v", js.String(), err)
+	}
+	if entry["level"] != "debug" || entry["msg"] != "fetching metrics" || entry["resourceId"] != id || entry["resources"] != float64(2) || entry["time"] != "2020-03-15T01:02:03.000Z" {
+		t.Errorf("json log = %v", entry)
+	}
+
+	for _, s := range []string{"debug", "INFO", "warn", "error"} {
+		if _, err := parseLogLevel(s); err != nil {
+			t.Errorf("parseLogLevel(%s): %v", s, err)
+		}
+	}
+	if _, err := parseLogLevel("trace"); err == nil {
+		t.Errorf("parseLogLevel(trace): no error")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// lookupMaxQueryLength is the maximum length of a query of LookupByIDs.
+// Resource Graph rejects too long queries, so the IDs are split into multiple queries.
+const lookupMaxQueryLength = 12000
+
+// LookupByIDsInput is input parameters for LookupByIDs
+type LookupByIDsInput struct {
+	subscriptionIDs []string
+	ids             []string
+	columns         []KQLColumn
+}
+
+// lookupQuery returns the query of the resources of the IDs
+func lookupQuery(ids []string, columns []KQLColumn) *KQLQuery {
+	return NewKQLQuery("resources").Where(InFold("id", ids)).Project(columns...)
+}
+
+// uniqueIDs returns the IDs without empty and case-insensitively duplicated ones, in the original order
+func uniqueIDs(ids []string) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, id := range ids {
+		key := strings.ToLower(id)
+		if id == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, id)
+	}
+	return result
+}
+
+// chunkLookupIDs splits the IDs so that each query is within maxLength.
+// An ID longer than maxLength by itself makes a chunk of its own.
+func chunkLookupIDs(ids []string, columns []KQLColumn, maxLength int) [][]string {
+	// 空の文字列リテラル1つ分を除いたクエリの長さに、ID のリテラルと区切りの長さを足していく
+	base := len(lookupQuery([]string{""}, columns).String()) - len(`""`)
+	var chunks [][]string
+	var chunk []string
+	length := base
+	for _, id := range ids {
+		n := len(KQLString(id))
+		if len(chunk) > 0 {
+			n += len(", ")
+		}
+		if len(chunk) > 0 && length+n > maxLength {
+			chunks = append(chunks, chunk)
+			chunk = nil
+			length = base
+			n -= len(", ")
+		}
+		chunk = append(chunk, id)
+		length += n
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// LookupByIDs fetches the resources of the IDs and decodes them into rows, such as *Disks, in the order of the queries.
+// IDs are de-duplicated case-insensitively and split into queries within the length limit, which run concurrently
+// up to the Resource Graph concurrency. IDs of a query which failed or has a row which could not be decoded are recorded to errs
+// without their rows, and resources not found are omitted.
+func LookupByIDs(ctx context.Context, inventory ResourceInventory, params LookupByIDsInput, rows ResourceGraphRows, errs *EvaluationErrors) {
+	ids := uniqueIDs(params.ids)
+	chunks := chunkLookupIDs(ids, params.columns, lookupMaxQueryLength)
+	// クエリは並列に実行されるため、JSON のまま受け取ってからクエリの順に読み込む
+	results := make([]rawRows, len(chunks))
+
+	var wg sync.WaitGroup
+	s := semaphore.NewWeighted(int64(inventory.ResourceGraphConcurrency()))
+	progress := NewProgress("looking up resources", len(ids))
+	for i, chunk := range chunks {
+		// 中断する場合や割り込まれた場合は新しいクエリを開始しない
+		if errs.Aborted() {
+			break
+		}
+		if err := s.Acquire(interruptContext(ctx), 1); err != nil {
+			break
+		}
+		// 空きがあると割り込まれた後も Acquire は成功するため、改めて確認する
+		if interrupted(ctx) {
+			s.Release(1)
+			break
+		}
+		i, chunk := i, chunk
+		wg.Add(1)
+
+		go func() {
+			defer s.Release(1)
+			defer wg.Done()
+			defer progress.Add(len(chunk))
+			qr := buildQueryRequest(lookupQuery(chunk, params.columns), params.subscriptionIDs)
+			logger.Debug("looking up resources", "chunk", i+1, "chunks", len(chunks), "resources", len(chunk))
+			if err := FetchResourceGraphData(ctx, inventory, qr, &results[i]); err != nil {
+				logger.Warn("failed to look up resources", "query", qr.query, "error", err)
+				// 途中のページまでの結果は使わず、クエリに含まれるリソースはすべて評価できなかったものとする
+				results[i] = nil
+				for _, id := range chunk {
+					errs.Add(id, "", fmt.Errorf("fetch resource graph data failed: %v", err))
+				}
+				return
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, chunk := range results {
+		// 読み込めない行がある場合はクエリ全体を捨て、クエリに含まれるリソースのエラーとする
+		n := rows.Len()
+		for j, row := range chunk {
+			if err := appendResourceGraphRow(rows, j, row); err != nil {
+				rows.Truncate(n)
+				for _, id := range chunks[i] {
+					errs.Add(id, "", err)
+				}
+				break
+			}
+		}
+	}
+}
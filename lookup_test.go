@@ -0,0 +1,109 @@
+//go:build !release
+// +build !release
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestChunkLookupIDs(t *testing.T) {
+	var ids []string
+	for i := 0; i < 250; i++ {
+		ids = append(ids, fakeDiskID(fmt.Sprintf("disk-%03d", i)))
+	}
+	columns := Cols("id", "name")
+	const maxLength = 2000
+	chunks := chunkLookupIDs(ids, columns, maxLength)
+	if len(chunks) < 2 {
+		t.Fatalf("chunks = %d, want more than 1", len(chunks))
+	}
+	var all []string
+	for _, chunk := range chunks {
+		if q := lookupQuery(chunk, columns).String(); len(q) > maxLength {
+			t.Errorf("query length = %d, want <= %d", len(q), maxLength)
+		}
+		all = append(all, chunk...)
+	}
+	if strings.Join(all, ",") != strings.Join(ids, ",") {
+		t.Errorf("chunked IDs differ from the IDs")
+	}
+
+	// 上限より長い ID は単独で1つのクエリにする
+	long := "/" + strings.Repeat("x", maxLength)
+	chunks = chunkLookupIDs([]string{ids[0], long, ids[1]}, columns, maxLength)
+	if len(chunks) != 3 || chunks[1][0] != long {
+		t.Errorf("chunks with a long ID = %d", len(chunks))
+	}
+}
+
+func TestUniqueIDs(t *testing.T) {
+	got := uniqueIDs([]string{"/a/B", "", "/a/b", "/c", "/A/b", "/c"})
+	if strings.Join(got, ",") != "/a/B,/c" {
+		t.Errorf("uniqueIDs = %v", got)
+	}
+}
+
+func TestLookupByIDs(t *testing.T) {
+	backend := &FakeBackend{}
+	var ids []string
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("disk-%03d", i)
+		backend.Resources = append(backend.Resources, fakeDisk(name, "Reserved", nil))
+		ids = append(ids, fakeDiskID(name), strings.ToUpper(fakeDiskID(name)))
+	}
+	ids = append(ids, "", fakeDiskID("missing"))
+
+	errs := NewEvaluationErrors(false)
+	input := LookupByIDsInput{subscriptionIDs: []string{"sub"}, ids: ids, columns: Cols("id", "name")}
+	var result Disks
+	LookupByIDs(context.Background(), backend, input, &result, errs)
+	if len(result) != 300 {
+		t.Fatalf("resources = %d, want 300", len(result))
+	}
+	for i, d := range result {
+		if d.Name != fmt.Sprintf("disk-%03d", i) {
+			t.Fatalf("resource %d = %s", i, d.Name)
+		}
+	}
+	if errs.Len() != 0 {
+		t.Errorf("evaluation errors = %v", errs.List())
+	}
+}
+
+func TestLookupByIDsUndecodableRow(t *testing.T) {
+	backend := &FakeBackend{}
+	var ids []string
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("disk-%03d", i)
+		backend.Resources = append(backend.Resources, fakeDisk(name, "Reserved", nil))
+		ids = append(ids, fakeDiskID(name))
+	}
+	// 1つのクエリの途中に読み込めない行を入れる
+	backend.Resources[150]["properties"] = map[string]interface{}{"diskSizeGB": "large"}
+
+	errs := NewEvaluationErrors(false)
+	input := LookupByIDsInput{subscriptionIDs: []string{"sub"}, ids: ids, columns: Cols("id", "name", "properties")}
+	var result Disks
+	LookupByIDs(context.Background(), backend, input, &result, errs)
+
+	failed := map[string]bool{}
+	for _, e := range errs.List() {
+		failed[strings.ToLower(e.ResourceID)] = true
+	}
+	if !failed[strings.ToLower(fakeDiskID("disk-150"))] {
+		t.Fatalf("evaluation errors = %v", errs.List())
+	}
+	// 検出結果と評価できなかったリソースの両方に含まれるリソースはないこと
+	for _, d := range result {
+		if failed[strings.ToLower(d.ID)] {
+			t.Errorf("%s is both in the result and the evaluation errors", d.Name)
+		}
+	}
+	if len(result)+errs.Len() != 300 || len(result) == 0 {
+		t.Errorf("resources = %d, evaluation errors = %d", len(result), errs.Len())
+	}
+}
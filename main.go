@@ -1,71 +1,57 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"os"
-	"strings"
 
 	"github.com/urfave/cli/v2"
 )
 
 const (
-	// QueryConcurrency is number of query concurrency
+	// QueryConcurrency is the default number of concurrent metrics queries
 	QueryConcurrency = 20
 )
 
+// version is set with -ldflags "-X main.version=..." on release builds
+var version = "dev"
+
 func main() {
-	app := &cli.App{
-		Name:  "advisor",
-		Usage: "Azure Advisor",
-	}
-	app.Commands = []*cli.Command{
-		{
-			Name:   "disk",
-			Usage:  "Advisor for Disk",
-			Action: CheckDisk,
-		},
-		{
-			Name:   "vm",
-			Usage:  "Advisor for VM",
-			Action: CheckVM,
-		},
-		{
-			Name:   "hdinsight",
-			Usage:  "Advisor for HDInsight",
-			Action: CheckHDInsight,
-		},
-	}
-	app.Flags = []cli.Flag{
-		&cli.StringFlag{
-			Name:     "subscriptionID",
-			Required: true,
-		},
-	}
-	if err := app.Run(os.Args); err != nil {
+	if err := newApp().Run(os.Args); err != nil {
 		log.Fatal(err)
 	}
 }
 
-type ResourceGraphQueryProject struct {
-	columnName    string
-	queryProperty string
-}
-
-type ResourceGraphResponse map[string]interface{}
-
-func buildQueryRequest(baseQuery string, subscriptionID string, project []ResourceGraphQueryProject) ResourceGraphQueryRequestInput {
-	q := baseQuery
-
-	// project の組み立て
-	q += "|project "
-	for _, v := range project {
-		q += fmt.Sprintf("%s=%s,", v.columnName, v.queryProperty)
+// newApp returns the application with the subcommands and global flags
+func newApp() *cli.App {
+	app := &cli.App{
+		Name:    "advisor",
+		Usage:   "Azure Advisor",
+		Version: version,
 	}
-	q = strings.TrimRight(q, ",")
+	app.Commands = checkCommands()
+	app.Commands = append(app.Commands,
+		metricsCommand(),
+		schemaCommand(),
+	)
+	app.Commands = append(app.Commands, fakeAzureCommands()...)
+	app.Flags = append(scopeFlags(), authFlags()...)
+	app.Flags = append(app.Flags, retryFlags()...)
+	app.Flags = append(app.Flags, evaluationFlags()...)
+	app.Flags = append(app.Flags, timeoutFlags()...)
+	app.Flags = append(app.Flags, metricWindowFlags(true)...)
+	app.Flags = append(app.Flags, outputFlags(true)...)
+	app.Flags = append(app.Flags, metricsBatchFlags()...)
+	app.Flags = append(app.Flags, concurrencyFlags()...)
+	app.Flags = append(app.Flags, recordFlags()...)
+	app.Flags = append(app.Flags, endpointFlags()...)
+	app.Flags = append(app.Flags, logFlags()...)
+	app.Before = configureLogger
+	return app
+}
 
+func buildQueryRequest(query *KQLQuery, subscriptionIDs []string) ResourceGraphQueryRequestInput {
 	return ResourceGraphQueryRequestInput{
-		subscriptionID: subscriptionID,
-		query:          q,
+		subscriptionIDs: subscriptionIDs,
+		query:           query.String(),
 	}
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
+	"github.com/urfave/cli/v2"
+)
+
+// metricsCommand returns the command to inspect metrics of resources
+func metricsCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "metrics",
+		Usage: "Inspect metrics of resources",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List metrics available for a resource with units, aggregations, time grains and dimensions",
+				Action: ListMetrics,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "resource",
+						Usage:    "resource ID (e.g. /subscriptions/{id}/resourceGroups/{group}/providers/Microsoft.Sql/servers/{server}/databases/{database})",
+						Required: true,
+					},
+				},
+			},
+		},
+	}
+}
+
+// ListMetrics prints the metric definitions of the resource
+func ListMetrics(c *cli.Context) error {
+	resourceID, err := ParseResourceID(c.String("resource"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), UNKNOWN)
+	}
+	// スコープが指定されていない場合はリソースのサブスクリプションを対象にする
+	scope := NewSubscriptionScope(c)
+	if len(scope.SubscriptionIDs) == 0 && scope.ManagementGroupID == "" && !scope.AllSubscriptions {
+		scope.SubscriptionIDs = []string{resourceID.SubscriptionID}
+	}
+
+	ctx, cancel := newRunContext(c)
+	defer cancel()
+	client, err := newScopedClientFromContext(ctx, c, scope)
+	if err != nil {
+		return err
+	}
+	defs, err := client.MetricDefinitions(ctx, resourceID.String())
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("failed to list metrics of %s: %v", resourceID, err), UNKNOWN)
+	}
+	return writeMetricDefinitions(c.App.Writer, defs)
+}
+
+// writeMetricDefinitions writes the definitions as a table sorted by metric name
+func writeMetricDefinitions(w io.Writer, defs []insights.MetricDefinition) error {
+	defs = append([]insights.MetricDefinition{}, defs...)
+	sort.Slice(defs, func(i, j int) bool {
+		return metricDefinitionName(defs[i]) < metricDefinitionName(defs[j])
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tUNIT\tPRIMARY\tAGGREGATIONS\tTIME GRAINS\tDIMENSIONS")
+	for _, d := range defs {
+		var dimensions []string
+		if d.Dimensions != nil {
+			for _, dim := range *d.Dimensions {
+				if dim.Value != nil {
+					dimensions = append(dimensions, *dim.Value)
+				}
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			metricDefinitionName(d),
+			orDash(string(d.Unit)),
+			orDash(string(d.PrimaryAggregationType)),
+			orDash(strings.Join(supportedAggregations(d), ",")),
+			orDash(strings.Join(metricTimeGrains(d), ",")),
+			orDash(strings.Join(dimensions, ",")),
+		)
+	}
+	return tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func metricDefinitionName(d insights.MetricDefinition) string {
+	if d.Name == nil || d.Name.Value == nil {
+		return ""
+	}
+	return *d.Name.Value
+}
+
+// supportedAggregations returns the aggregation types of the metric except None
+func supportedAggregations(d insights.MetricDefinition) []string {
+	var result []string
+	if d.SupportedAggregationTypes != nil {
+		for _, a := range *d.SupportedAggregationTypes {
+			if a != insights.None {
+				result = append(result, string(a))
+			}
+		}
+	}
+	return result
+}
+
+// metricTimeGrains returns the time grains available for the metric
+func metricTimeGrains(d insights.MetricDefinition) []string {
+	var result []string
+	if d.MetricAvailabilities != nil {
+		for _, a := range *d.MetricAvailabilities {
+			if a.TimeGrain != nil {
+				result = append(result, *a.TimeGrain)
+			}
+		}
+	}
+	return result
+}
+
+// sameTimeGrain returns true when the time grains are the same duration such as PT24H and P1D
+func sameTimeGrain(a, b string) bool {
+	da, okA := supportedIntervals[strings.ToUpper(a)]
+	db, okB := supportedIntervals[strings.ToUpper(b)]
+	if okA && okB {
+		return da == db
+	}
+	return strings.EqualFold(a, b)
+}
+
+// ValidateMetricQuery checks the metrics of the query are defined and support the aggregations and the interval.
+// The error lists all problems so that the query can be fixed at once.
+func ValidateMetricQuery(defs []insights.MetricDefinition, query MetricQuery, interval string) error {
+	var problems []string
+	for _, name := range query.MetricNames {
+		var def *insights.MetricDefinition
+		for i := range defs {
+			if strings.EqualFold(metricDefinitionName(defs[i]), name) {
+				def = &defs[i]
+				break
+			}
+		}
+		if def == nil {
+			problems = append(problems, fmt.Sprintf("metric %q is not defined", name))
+			continue
+		}
+
+		// 定義に含まれない項目は検証しない
+		if supported := supportedAggregations(*def); len(supported) > 0 {
+			for _, a := range query.Aggregations {
+				if !containsFold(supported, a) {
+					problems = append(problems, fmt.Sprintf("metric %q does not support aggregation %s (supported: %s)", name, a, strings.Join(supported, ", ")))
+				}
+			}
+		}
+		if grains := metricTimeGrains(*def); len(grains) > 0 && interval != "" {
+			found := false
+			for _, g := range grains {
+				if sameTimeGrain(g, interval) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("metric %q is not available at interval %s (available: %s)", name, interval, strings.Join(grains, ", ")))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validateTargetMetrics validates the query with the metric definitions of the first target of each resource type.
+// Definitions which can not be fetched are skipped, and the metrics are fetched as usual.
+func validateTargetMetrics(ctx context.Context, source MetricsSource, targets []MetricTarget, query MetricQuery) error {
+	validated := map[string]bool{}
+	for _, t := range targets {
+		r, err := ParseResourceID(t.ID)
+		if err != nil {
+			continue
+		}
+		resourceType := strings.ToLower(r.Type())
+		if validated[resourceType] {
+			continue
+		}
+		validated[resourceType] = true
+
+		defs, err := source.MetricDefinitions(ctx, t.ID)
+		if err != nil {
+			logger.Warn("could not validate metrics with metric definitions", "resourceType", r.Type(), "error", err)
+			continue
+		}
+		if len(defs) == 0 {
+			logger.Debug("no metric definitions to validate metrics", "resourceType", r.Type())
+			continue
+		}
+		if err := ValidateMetricQuery(defs, query, source.MetricsInterval()); err != nil {
+			return fmt.Errorf("invalid metrics for %s: %v (run 'advisor metrics list --resource %s' to see available metrics)", r.Type(), err, t.ID)
+		}
+	}
+	return nil
+}
+
+// MetricDefinitions returns the metric definitions of the resource
+func (c *Client) MetricDefinitions(ctx context.Context, resourceID string) ([]insights.MetricDefinition, error) {
+	r, err := ParseResourceID(resourceID)
+	if err != nil {
+		return nil, err
+	}
+	defs, err := FetchMetricDefinitions(ctx, c, FetchMetricDefinitionsInput{resourceID: r})
+	if err != nil || defs == nil {
+		return nil, err
+	}
+	return *defs, nil
+}
+
+// MetricsInterval returns the interval of the metric window
+func (c *Client) MetricsInterval() string {
+	return c.MetricWindow.Interval
+}
+
+// containsFold returns true when the list contains v case-insensitively
+func containsFold(list []string, v string) bool {
+	for _, s := range list {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
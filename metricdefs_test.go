@@ -0,0 +1,101 @@
+//go:build !release
+// +build !release
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func fakeMetricDefinition(name string, aggregations []insights.AggregationType, grains ...string) insights.MetricDefinition {
+	var availabilities []insights.MetricAvailability
+	for _, g := range grains {
+		availabilities = append(availabilities, insights.MetricAvailability{TimeGrain: to.StringPtr(g)})
+	}
+	return insights.MetricDefinition{
+		Name:                      &insights.LocalizableString{Value: to.StringPtr(name)},
+		Unit:                      insights.UnitPercent,
+		PrimaryAggregationType:    aggregations[0],
+		SupportedAggregationTypes: &aggregations,
+		MetricAvailabilities:      &availabilities,
+		Dimensions:                &[]insights.LocalizableString{{Value: to.StringPtr("VMName")}},
+	}
+}
+
+func TestValidateMetricQuery(t *testing.T) {
+	defs := []insights.MetricDefinition{
+		fakeMetricDefinition("Percentage CPU", []insights.AggregationType{insights.Average, insights.Maximum}, "PT1H", "P1D"),
+	}
+	tests := []struct {
+		query    MetricQuery
+		interval string
+		want     []string
+	}{
+		{MetricQuery{MetricNames: []string{"percentage cpu"}, Aggregations: []string{"Average", "Maximum"}}, "PT24H", nil},
+		{MetricQuery{MetricNames: []string{"Percentage CPU", "CPU Credits"}, Aggregations: []string{"Average"}}, "PT1H", []string{`metric "CPU Credits" is not defined`}},
+		{MetricQuery{MetricNames: []string{"Percentage CPU"}, Aggregations: []string{"Total"}}, "PT5M", []string{"does not support aggregation Total (supported: Average, Maximum)", "not available at interval PT5M (available: PT1H, P1D)"}},
+	}
+	for _, tt := range tests {
+		err := ValidateMetricQuery(defs, tt.query, tt.interval)
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("ValidateMetricQuery(%v): %v", tt.query, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("ValidateMetricQuery(%v): no error", tt.query)
+			continue
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(err.Error(), w) {
+				t.Errorf("error %q does not contain %q", err, w)
+			}
+		}
+	}
+}
+
+func TestFetchTargetMetricsInvalidMetric(t *testing.T) {
+	backend := newFakeVMBackend()
+	vms, err := getVM(context.Background(), backend, []string{"sub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := NewEvaluationErrors(false)
+	called := false
+	query := MetricQuery{MetricNames: []string{"Percentage CPUs"}, Aggregations: []string{"Average"}}
+	err = FetchTargetMetrics(context.Background(), backend, vmMetricTargets(*vms), query, errs, func(int, map[string][]insights.MetricValue) {
+		called = true
+	})
+	// 存在しないメトリックは取得前にエラーにし、リソースを評価しない
+	if err == nil || !strings.Contains(err.Error(), `metric "Percentage CPUs" is not defined`) || !strings.Contains(err.Error(), "advisor metrics list --resource") {
+		t.Errorf("err = %v", err)
+	}
+	if called {
+		t.Errorf("resources were evaluated with an invalid metric")
+	}
+}
+
+func TestWriteMetricDefinitions(t *testing.T) {
+	defs := []insights.MetricDefinition{
+		fakeMetricDefinition("Percentage CPU", []insights.AggregationType{insights.Average, insights.None, insights.Maximum}, "PT1M", "PT1H"),
+		{Name: &insights.LocalizableString{Value: to.StringPtr("Disk Read Bytes")}},
+	}
+	var b bytes.Buffer
+	if err := writeMetricDefinitions(&b, defs); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "NAME") || !strings.HasPrefix(lines[1], "Disk Read Bytes") {
+		t.Fatalf("output = %s", b.String())
+	}
+	if fields := strings.Fields(lines[2]); strings.Join(fields[2:], " ") != "Percent Average Average,Maximum PT1M,PT1H VMName" {
+		t.Errorf("Percentage CPU = %q", lines[2])
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/semaphore"
+)
+
+// Azure Monitor metrics batch API
+const (
+	metricsBatchEndpoint   = "https://{region}.metrics.monitor.azure.com"
+	metricsBatchAPIVersion = "2023-10-01"
+	// metricsBatchSize is the maximum number of resources per request of the batch API
+	metricsBatchSize = 50
+)
+
+// metricsBatchFlags returns global flags for the metrics batch API
+func metricsBatchFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "metricsBatch",
+			Value: true,
+			Usage: "fetch metrics of multiple resources in one request with the metrics batch API (--metricsBatch=false to fetch per resource)",
+		},
+	}
+}
+
+// MetricsBatchClient is a client of the metrics batch API.
+// The API has a regional endpoint and needs a token of its own audience.
+type MetricsBatchClient struct {
+	autorest.Client
+	// Endpoint is the regional endpoint with {region} placeholder
+	Endpoint string
+}
+
+// NewMetricsBatchClient returns *MetricsBatchClient with setting Authorizer
+func NewMetricsBatchClient(authorizer autorest.Authorizer) *MetricsBatchClient {
+	client := &MetricsBatchClient{
+		Client:   autorest.NewClientWithUserAgent("azureadvisor"),
+		Endpoint: metricsBatchEndpoint,
+	}
+	client.Authorizer = authorizer
+	return client
+}
+
+// MetricTarget is a resource whose metrics are fetched.
+// ID is the resource ID returned by Resource Graph, which may be of a child resource.
+type MetricTarget struct {
+	ID       string
+	Name     string
+	Location string
+}
+
+// MetricQuery is metrics and aggregations fetched for each target
+type MetricQuery struct {
+	MetricNames  []string
+	Aggregations []string
+}
+
+// MetricsBatchInput is input parameters for FetchMetricDataBatch.
+// All resources must be in the same subscription, region and namespace.
+type MetricsBatchInput struct {
+	subscriptionID string
+	region         string
+	namespace      string
+	resourceIDs    []string
+	metricNames    []string
+	aggregations   []string
+	window         MetricWindow
+}
+
+type metricsBatchRequest struct {
+	ResourceIDs []string `json:"resourceids"`
+}
+
+type metricsBatchResponse struct {
+	Values []struct {
+		ResourceID string            `json:"resourceid"`
+		Value      []insights.Metric `json:"value"`
+	} `json:"values"`
+}
+
+// FetchMetricDataBatch fetches metric data of the resources with the batch API and returns values with
+// the lower-cased resource ID and metric name as hash keys.
+// Values which have none of the aggregations are skipped.
+func FetchMetricDataBatch(ctx context.Context, c *Client, params MetricsBatchInput) (map[string]map[string][]insights.MetricValue, error) {
+	if c.MetricsBatchClient == nil {
+		return nil, fmt.Errorf("metrics batch API is disabled")
+	}
+	end := time.Now().UTC()
+	start := end.Add(-params.window.Lookback)
+	region := strings.ToLower(strings.ReplaceAll(params.region, " ", ""))
+
+	req, err := autorest.Prepare((&http.Request{}).WithContext(ctx),
+		autorest.AsContentType("application/json; charset=utf-8"),
+		autorest.AsPost(),
+		autorest.WithBaseURL(strings.Replace(c.MetricsBatchClient.Endpoint, "{region}", region, -1)),
+		autorest.WithPathParameters("/subscriptions/{subscriptionId}/metrics:getBatch", map[string]interface{}{
+			"subscriptionId": autorest.Encode("path", params.subscriptionID),
+		}),
+		autorest.WithJSON(metricsBatchRequest{ResourceIDs: params.resourceIDs}),
+		autorest.WithQueryParameters(map[string]interface{}{
+			"api-version":     metricsBatchAPIVersion,
+			"starttime":       autorest.Encode("query", start.Format(time.RFC3339)),
+			"endtime":         autorest.Encode("query", end.Format(time.RFC3339)),
+			"interval":        autorest.Encode("query", params.window.Interval),
+			"metricnamespace": autorest.Encode("query", params.namespace),
+			"metricnames":     autorest.Encode("query", strings.Join(params.metricNames, ",")),
+			"aggregation":     autorest.Encode("query", strings.Join(params.aggregations, ",")),
+		}),
+		c.MetricsBatchClient.WithAuthorization(),
+	)
+	if err != nil {
+		// バッチ API 用のトークンが取得できない場合もリソースごとの取得に切り替える
+		return nil, metricsBatchUnavailableError{err: err}
+	}
+
+	resp, err := autorest.SendWithSender(c.MetricsBatchClient, req, autorest.GetSendDecorators(c.withRetry(ctx, c.MetricsLimiter))...)
+	if err != nil {
+		return nil, autorest.NewErrorWithError(err, "MetricsBatchClient", "FetchMetricDataBatch", resp, "Failure sending request")
+	}
+	var result metricsBatchResponse
+	err = autorest.Respond(
+		resp,
+		azure.WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByUnmarshallingJSON(&result),
+		autorest.ByClosing(),
+	)
+	if err != nil {
+		return nil, autorest.NewErrorWithError(err, "MetricsBatchClient", "FetchMetricDataBatch", resp, "Failure responding to request")
+	}
+
+	metricsList := make(map[string]map[string][]insights.MetricValue)
+	for _, r := range result.Values {
+		metrics := make(map[string][]insights.MetricValue)
+		for _, v := range r.Value {
+			if v.Name == nil || v.Name.Value == nil || v.Timeseries == nil {
+				continue
+			}
+			for _, elem := range *v.Timeseries {
+				if elem.Data == nil {
+					continue
+				}
+				for _, d := range *elem.Data {
+					if !hasAggregation(d, params.aggregations) {
+						continue
+					}
+					if d.TimeStamp == nil {
+						continue
+					}
+					metrics[*v.Name.Value] = append(metrics[*v.Name.Value], d)
+				}
+			}
+		}
+		metricsList[strings.ToLower(r.ResourceID)] = metrics
+	}
+	return metricsList, nil
+}
+
+// metricsBatchUnavailableError is an error occurred before sending the batch request
+type metricsBatchUnavailableError struct {
+	err error
+}
+
+func (e metricsBatchUnavailableError) Error() string {
+	return fmt.Sprintf("metrics batch API is unavailable: %v", e.err)
+}
+
+// batchUnsupported returns true when the batch request was rejected and the resources should be fetched one by one
+func batchUnsupported(err error) bool {
+	if _, ok := err.(metricsBatchUnavailableError); ok {
+		return true
+	}
+	de, ok := err.(autorest.DetailedError)
+	if !ok {
+		return false
+	}
+	code, ok := de.StatusCode.(int)
+	if !ok {
+		return false
+	}
+	return code >= 400 && code < 500 && code != http.StatusTooManyRequests
+}
+
+// groupMetricTargets returns indexes of targets grouped by subscription, region and namespace.
+// Each group has at most size targets.
+func groupMetricTargets(targets []MetricTarget, size int) [][]int {
+	var keys []string
+	groups := map[string][]int{}
+	for i, t := range targets {
+		// 不正な ID はまとめずに個別の取得でエラーにする
+		key := strings.ToLower(t.ID)
+		if r, err := ParseResourceID(t.ID); err == nil {
+			key = strings.ToLower(strings.Join([]string{r.SubscriptionID, strings.ReplaceAll(t.Location, " ", ""), r.Type()}, "/"))
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	var result [][]int
+	for _, key := range keys {
+		g := groups[key]
+		for len(g) > size {
+			result = append(result, g[:size])
+			g = g[size:]
+		}
+		result = append(result, g)
+	}
+	return result
+}
+
+// FetchTargetMetrics fetches metrics of the targets concurrently and calls evaluate with metrics of each target.
+// Targets are grouped by subscription, region and namespace up to the batch size of the source.
+// evaluate is not called concurrently. Errors are recorded to errs per target.
+// It returns an error without fetching when the query does not match the metric definitions.
+func FetchTargetMetrics(ctx context.Context, source MetricsSource, targets []MetricTarget, query MetricQuery, errs *EvaluationErrors, evaluate func(i int, metrics map[string][]insights.MetricValue)) error {
+	// 存在しないメトリックは空の結果になり、利用していないリソースと判定されるため事前に検証する
+	if err := validateTargetMetrics(ctx, source, targets, query); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	mutex := &sync.Mutex{}
+	s := semaphore.NewWeighted(int64(source.MetricsConcurrency()))
+	progress := NewProgress("evaluating resources", len(targets))
+
+	for _, group := range groupMetricTargets(targets, source.MetricsBatchSize()) {
+		// 中断する場合や割り込まれた場合は新しいリソースの評価を開始しない
+		if errs.Aborted() {
+			break
+		}
+		if err := s.Acquire(interruptContext(ctx), 1); err != nil {
+			break
+		}
+		// 空きがあると割り込まれた後も Acquire は成功するため、改めて確認する
+		if interrupted(ctx) {
+			s.Release(1)
+			break
+		}
+		group := group
+		wg.Add(1)
+
+		go func() {
+			defer s.Release(1)
+			defer wg.Done()
+			var groupTargets []MetricTarget
+			for _, i := range group {
+				groupTargets = append(groupTargets, targets[i])
+			}
+			results := source.FetchMetrics(ctx, groupTargets, query)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			progress.Add(len(results))
+			for _, r := range results {
+				i := group[r.Index]
+				if r.Err != nil {
+					logger.Debug("failed to fetch metrics", "resourceId", targets[i].ID, "error", r.Err)
+					errs.Add(targets[i].ID, targets[i].Name, r.Err)
+					continue
+				}
+				evaluate(i, r.Metrics)
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// MetricsBatchSize returns the number of resources per request of the batch API, or 1 when it is disabled
+func (c *Client) MetricsBatchSize() int {
+	if c.MetricsBatchClient == nil {
+		return 1
+	}
+	return metricsBatchSize
+}
+
+// FetchMetrics fetches metrics of the targets with the batch API, and fetches them one by one when the batch is rejected
+func (c *Client) FetchMetrics(ctx context.Context, targets []MetricTarget, query MetricQuery) []TargetMetrics {
+	var results []TargetMetrics
+	var pending []int
+	for i := range targets {
+		pending = append(pending, i)
+	}
+
+	// 同じグループのリソースはサブスクリプションと種類が同じため、先頭の ID で代表する
+	first, err := ParseResourceID(targets[0].ID)
+	if len(targets) > 1 && err == nil {
+		location := targets[0].Location
+		logger.Debug("fetching metrics with the batch API", "resources", len(targets), "location", location, "namespace", first.Type())
+		var ids []string
+		for _, t := range targets {
+			ids = append(ids, t.ID)
+		}
+		input := MetricsBatchInput{
+			subscriptionID: first.SubscriptionID,
+			region:         location,
+			namespace:      first.Type(),
+			resourceIDs:    ids,
+			metricNames:    query.MetricNames,
+			aggregations:   query.Aggregations,
+			window:         c.MetricWindow,
+		}
+		batch, err := FetchMetricDataBatch(ctx, c, input)
+		switch {
+		case err == nil:
+			// レスポンスに含まれないリソースは個別に取得する
+			pending = nil
+			for i, t := range targets {
+				if metrics, ok := batch[strings.ToLower(t.ID)]; ok {
+					results = append(results, TargetMetrics{Index: i, Metrics: metrics})
+				} else {
+					pending = append(pending, i)
+				}
+			}
+		case batchUnsupported(err):
+			logger.Warn("metrics batch request failed, fetching per resource", "error", err)
+		default:
+			for i := range targets {
+				results = append(results, TargetMetrics{Index: i, Err: err})
+			}
+			return results
+		}
+	}
+
+	for _, i := range pending {
+		if interrupted(ctx) {
+			break
+		}
+		t := targets[i]
+		logger.Debug("fetching metrics", "resourceId", t.ID)
+		resourceID, err := ParseResourceID(t.ID)
+		if err != nil {
+			results = append(results, TargetMetrics{Index: i, Err: err})
+			continue
+		}
+		input := FetchMetricDataInput{
+			resourceID:   resourceID,
+			aggregations: query.Aggregations,
+			metricNames:  query.MetricNames,
+			window:       c.MetricWindow,
+		}
+		metrics, err := FetchMetricData(ctx, c, input)
+		results = append(results, TargetMetrics{Index: i, Metrics: metrics, Err: err})
+	}
+	return results
+}
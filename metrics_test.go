@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights/insightsapi"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+func TestFetchTargetMetricsBatch(t *testing.T) {
+	var batchRequests []metricsBatchRequest
+	var listRequests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/metrics:getBatch") {
+			if !strings.HasPrefix(r.URL.Path, "/japaneast/subscriptions/sub/") {
+				t.Errorf("unexpected path: %s", r.URL.Path)
+			}
+			var req metricsBatchRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				// ハンドラーは別の goroutine で実行されるため Fatal は使わない
+				t.Error(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			batchRequests = append(batchRequests, req)
+			// vm2 はレスポンスに含めず、リソースごとの取得にフォールバックさせる
+			w.Write([]byte(`{"values":[{"resourceid":"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1","value":[
+				{"name":{"value":"Percentage CPU"},"timeseries":[{"data":[{"timestamp":"2020-03-01T00:00:00Z","average":10}]}]}
+			]}]}`))
+			return
+		}
+		listRequests = append(listRequests, r.URL.Path)
+		w.Write([]byte(`{"value":[{"name":{"value":"Percentage CPU"},"timeseries":[{"data":[{"timeStamp":"2020-03-01T00:00:00Z"}]}]}]}`))
+	}))
+	defer server.Close()
+
+	client := &Client{
+		MetricsClients: map[string]insightsapi.MetricsClientAPI{
+			"sub": insights.NewMetricsClientWithBaseURI(server.URL, "sub"),
+		},
+		MetricsBatchClient: &MetricsBatchClient{
+			Client:   autorest.NewClientWithUserAgent("test"),
+			Endpoint: server.URL + "/{region}",
+		},
+		RetryPolicy:  DefaultRetryPolicy,
+		RetryStats:   &RetryStats{},
+		MetricWindow: DefaultMetricWindow,
+	}
+	var targets []MetricTarget
+	for _, name := range []string{"vm1", "vm2"} {
+		targets = append(targets, MetricTarget{
+			ID:       "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/" + name,
+			Name:     name,
+			Location: "japaneast",
+		})
+	}
+	query := MetricQuery{MetricNames: []string{"Percentage CPU"}, Aggregations: []string{"Average"}}
+	errs := NewEvaluationErrors(false)
+
+	counts := map[string]int{}
+	FetchTargetMetrics(context.Background(), client, targets, query, errs, func(i int, metrics map[string][]insights.MetricValue) {
+		counts[targets[i].Name] = len(metrics["Percentage CPU"])
+	})
+
+	if errs.Len() != 0 {
+		t.Fatalf("unexpected errors: %v", errs.List())
+	}
+	if len(batchRequests) != 1 || len(batchRequests[0].ResourceIDs) != 2 {
+		t.Errorf("batch requests = %+v, want 1 request with 2 resources", batchRequests)
+	}
+	if len(listRequests) != 1 || !strings.HasSuffix(listRequests[0], "/vm2/providers/microsoft.insights/metrics") {
+		t.Errorf("per-resource requests = %v, want vm2 only", listRequests)
+	}
+	if counts["vm1"] != 1 || counts["vm2"] != 0 {
+		t.Errorf("unexpected metrics: %v", counts)
+	}
+}
+
+func TestGroupMetricTargets(t *testing.T) {
+	targets := []MetricTarget{
+		{ID: "/subscriptions/sub/resourceGroups/rg/providers/microsoft.compute/virtualmachines/vm1", Location: "japaneast"},
+		{ID: "/subscriptions/sub/resourceGroups/rg/providers/microsoft.compute/virtualmachines/vm2", Location: "westus"},
+		{ID: "/subscriptions/SUB/resourceGroups/rg2/providers/Microsoft.Compute/virtualMachines/vm3", Location: "Japan East"},
+		{ID: "/subscriptions/sub/resourceGroups/rg/providers/microsoft.compute/virtualmachines/vm4", Location: "japaneast"},
+		{ID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Sql/servers/sql1/databases/db1", Location: "japaneast"},
+		{ID: "invalid", Location: "japaneast"},
+	}
+	groups := groupMetricTargets(targets, 2)
+	want := [][]int{{0, 2}, {3}, {1}, {4}, {5}}
+	if len(groups) != len(want) {
+		t.Fatalf("groups = %v, want %v", groups, want)
+	}
+	for i := range want {
+		if len(groups[i]) != len(want[i]) {
+			t.Fatalf("groups = %v, want %v", groups, want)
+		}
+		for j := range want[i] {
+			if groups[i][j] != want[i][j] {
+				t.Errorf("groups = %v, want %v", groups, want)
+			}
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
+	htmltemplate "html/template"
+	"io"
 	"io/ioutil"
-	"os"
+	"net/http"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -14,77 +18,133 @@ import (
 
 //go:generate statik -f -src tmpl
 
-func outputToFile(data interface{}, outputFilePath string, templateName string) error {
-	file, err := os.Create(outputFilePath)
+// ReportInfo is information of the run shown in the report
+type ReportInfo struct {
+	EvaluationErrors []EvaluationError
+	// Incomplete is the reason why the run did not complete
+	Incomplete   string
+	MetricWindow MetricWindow
+	// Checks is the IDs of the checks which ran
+	Checks []string
+}
+
+// executor is a parsed text/template or html/template
+type executor interface {
+	ExecuteTemplate(w io.Writer, name string, data interface{}) error
+}
+
+// readTemplate returns the content of the template embedded in the binary
+func readTemplate(statikFs http.FileSystem, name string) (string, error) {
+	f, err := statikFs.Open("/" + name)
 	if err != nil {
-		return err
+		return "", err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// formatEvidence returns the value of the evidence in the HTML and CSV.
+// Floats are written without rounding unless the value has its own format such as Percentage.
+func formatEvidence(v interface{}) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
 	}
-	defer file.Close()
+	return fmt.Sprint(v)
+}
 
+// renderTemplate renders the template with data and the information of the run.
+// HTML templates are rendered with html/template so that values such as error messages are escaped,
+// and can use the header and information templates.
+func renderTemplate(w io.Writer, data interface{}, reportInfo *ReportInfo, templateName string) error {
 	statikFs, err := fs.New()
 	if err != nil {
 		return err
 	}
 
 	// ----- コンテンツテンプレート
-	templateFile, err := statikFs.Open("/" + templateName)
-	if err != nil {
-		return err
-	}
-	templateBytes, err := ioutil.ReadAll(templateFile)
+	content, err := readTemplate(statikFs, templateName)
 	if err != nil {
 		return err
 	}
 	// --------------
 
-	funcs := template.FuncMap{
+	funcs := map[string]interface{}{
 		"add": func(x, y int) int {
 			return x + y
 		},
+		"csv": func(v interface{}) string {
+			return `"` + strings.ReplaceAll(fmt.Sprint(v), `"`, `""`) + `"`
+		},
+		"evidence": func(f Finding, key string) string {
+			v, ok := f.Evidence[key]
+			if !ok {
+				return ""
+			}
+			return formatEvidence(v)
+		},
+		"savings": func(f Finding) string {
+			if f.EstimatedSavings == nil {
+				return ""
+			}
+			return fmt.Sprintf("%.2f %s", f.EstimatedSavings.MonthlyAmount, f.EstimatedSavings.Currency)
+		},
 	}
-	tpl := template.Must(template.New(templateName).Funcs(funcs).Parse(string(templateBytes)))
 
+	var tpl executor
 	// HTML テンプレートを指定された場合
-	if strings.Index(templateName, ".html") > -1 {
-
-		// ----- ヘッダーテンプレート
-		headerTemplateFile, err := statikFs.Open("/header.tmpl.html")
-		if err != nil {
-			return err
-		}
-		headerTemplateBytes, err := ioutil.ReadAll(headerTemplateFile)
-		if err != nil {
-			return err
-		}
-		// --------------
-
-		// ----- 共通テンプレート
-		infoTemplateFile, err := statikFs.Open("/information.tmpl.html")
+	if strings.HasSuffix(templateName, ".html") {
+		// ----- ヘッダーテンプレートと共通テンプレート
+		header, err := readTemplate(statikFs, "header.tmpl.html")
 		if err != nil {
 			return err
 		}
-		infoTemplateBytes, err := ioutil.ReadAll(infoTemplateFile)
+		information, err := readTemplate(statikFs, "information.tmpl.html")
 		if err != nil {
 			return err
 		}
 		// --------------
-		tplInformation := template.Must(template.New("information").Funcs(funcs).Parse(string(infoTemplateBytes)))
-		tplHeader := template.Must(template.New("information").Funcs(funcs).Parse(string(headerTemplateBytes)))
-		tpl.AddParseTree("information", tplInformation.Tree)
-		tpl.AddParseTree("header", tplHeader.Tree)
+		t := htmltemplate.Must(htmltemplate.New(templateName).Funcs(funcs).Parse(content))
+		htmltemplate.Must(t.New("header").Parse(header))
+		htmltemplate.Must(t.New("information").Parse(information))
+		tpl = t
+	} else {
+		tpl = template.Must(template.New(templateName).Funcs(funcs).Parse(content))
 	}
 
 	info := map[string]interface{}{
-		"createdDate": time.Now().Format("2006-01-02 15:04:05"),
+		"createdDate":      time.Now().Format("2006-01-02 15:04:05"),
+		"evaluationErrors": reportInfo.EvaluationErrors,
+		"incomplete":       reportInfo.Incomplete,
+		"lookback":         reportInfo.MetricWindow.LookbackString(),
+		"interval":         reportInfo.MetricWindow.Interval,
+		"checks":           strings.Join(reportInfo.Checks, ", "),
 	}
 	d := map[string]interface{}{
 		"Data": data,
 		"Info": info,
 	}
 
-	if err = tpl.ExecuteTemplate(file, templateName, d); err != nil {
-		return err
-	}
+	return tpl.ExecuteTemplate(w, templateName, d)
+}
+
+func outputToFile(data interface{}, reportInfo *ReportInfo, outputFilePath string, templateName string) error {
+	// 中断された場合に書きかけのファイルが残らないよう、一時ファイルに書き込んでから置き換える
+	return writeFileAtomic(outputFilePath, func(w io.Writer) error {
+		return renderTemplate(w, data, reportInfo, templateName)
+	})
+}
 
-	return nil
+// outputEvaluationErrors writes the resources which could not be evaluated to CSV when there are any
+func outputEvaluationErrors(list []EvaluationError, outputFilePath string) error {
+	if len(list) == 0 {
+		return nil
+	}
+	return outputToFile(list, &ReportInfo{}, outputFilePath, "evaluationerrors.tmpl.csv")
 }
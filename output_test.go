@@ -1,71 +1,80 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"strings"
 	"testing"
 )
 
-func TestDiskOutput(t *testing.T) {
-	disks1 := []Disk{}
-	disks1 = append(disks1, Disk{
-		ID:       "ID",
-		Location: "JapanEast",
-		Name:     "Disk",
-		Properties: struct {
-			DiskSizeGB  int    "json:\"diskSizeGB\""
-			TimeCreated string "json:\"timeCreated\""
-			DiskState   string "json:\"diskState\""
-		}{
-			DiskSizeGB: 10,
-		},
-		ResourceGroup: "ResourceGroup",
-		Sku: struct {
-			Name string "json:\"name\""
-		}{
-			Name: "Premium",
-		},
-	})
-	disks1 = append(disks1, Disk{
-		ID:       "ID",
-		Location: "JapanEast",
-		Name:     "Disk",
-		Properties: struct {
-			DiskSizeGB  int    "json:\"diskSizeGB\""
-			TimeCreated string "json:\"timeCreated\""
-			DiskState   string "json:\"diskState\""
-		}{
-			DiskSizeGB: 20,
-		},
-		ResourceGroup: "ResourceGroup",
-		Sku: struct {
-			Name string "json:\"name\""
-		}{
-			Name: "Premium",
-		},
-	})
+func newTestDiskReport() *FindingsReport {
+	disk := Disk{ID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk1", SubscriptionID: "sub", ResourceGroup: "rg", Name: "disk1", Location: "japaneast"}
+	disk.Sku.Name = "Premium_LRS"
+	disk.Properties.DiskSizeGB = 128
+	disk.Properties.DiskState = "Unattached"
+	findings := diskFindings(categoryUnattachedDisks, SeverityMedium, `disk is "unattached"`, []Disk{disk})
+	// カテゴリが宣言されていない検出結果も出力されること
+	findings = append(findings, Finding{Check: "other", Category: "Other", ResourceName: "other1", Reason: "<b>bold</b>", Evidence: map[string]interface{}{"Ratio": 0.25, "CPU": Percentage(12.345)}})
+	info := &ReportInfo{
+		EvaluationErrors: []EvaluationError{{ResourceID: "/subscriptions/sub/vm2", Name: "vm2", Err: errors.New("throttled: <html><body>Too Many Requests</body></html>")}},
+		MetricWindow:     DefaultMetricWindow,
+	}
+	return NewFindingsReport("disk", []string{"sub"}, info, []Category{categoryUnattachedDisks, categoryUnusedVMDisks}, findings)
+}
 
-	disks2 := []Disk{}
-	disks2 = append(disks2, Disk{
-		ID:       "ID",
-		Location: "JapanWast",
-		Name:     "Disk",
-		Properties: struct {
-			DiskSizeGB  int    "json:\"diskSizeGB\""
-			TimeCreated string "json:\"timeCreated\""
-			DiskState   string "json:\"diskState\""
-		}{
-			DiskSizeGB: 20,
-		},
-		ResourceGroup: "ResourceGroup",
-		Sku: struct {
-			Name string "json:\"name\""
-		}{
-			Name: "Premium",
-		},
-	})
-	m := map[string][]Disk{}
-	m["Data1"] = disks1
-	m["Data2"] = disks2
+func TestFindingsReportHTML(t *testing.T) {
+	var b bytes.Buffer
+	if err := newTestDiskReport().WriteHTML(&b); err != nil {
+		t.Fatal(err)
+	}
+	html := b.String()
+	for _, want := range []string{`<h1 id="UnattachedDisks">Unattached Disks</h1>`, `<h1 id="UnusedVMDisks">Unused VM&#39;s Disks</h1>`, `<h1 id="Other">Other</h1>`, "<th>DiskSizeGB</th>", "<td>128</td>", "<td>0.25</td>", "<td>12.3</td>", "<td>vm2</td>", "30d", `<a href="#UnusedVMDisks">Unused VM&#39;s Disks</a>`} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML does not contain %s", want)
+		}
+	}
+	// 理由やエラーメッセージはエスケープされること
+	for _, want := range []string{"&lt;b&gt;bold&lt;/b&gt;", "throttled: &lt;html&gt;&lt;body&gt;Too Many Requests"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML does not contain %s", want)
+		}
+	}
+	if strings.Contains(html, "<b>bold</b>") || strings.Contains(html, "<body>Too Many") {
+		t.Errorf("HTML contains unescaped values")
+	}
+}
 
-	outputToFile(m, "result_disks.html", "disks.tmpl.html")
+func TestFindingsReportCSV(t *testing.T) {
+	var b bytes.Buffer
+	if err := newTestDiskReport().WriteCSV(&b); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("CSV = %s", b.String())
+	}
+	// 証跡の列はすべての検出結果のキーを並べたもの
+	if !strings.HasSuffix(lines[0], `,"CPU","DiskSizeGB","DiskState","Ratio","SkuName","TimeCreated"`) {
+		t.Errorf("header = %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"disk is ""unattached""",""`) || !strings.Contains(lines[1], `,"128","Unattached","","Premium_LRS",""`) {
+		t.Errorf("row = %s", lines[1])
+	}
+	// CSV はエスケープせず、小数は丸めない
+	if !strings.Contains(lines[2], `"<b>bold</b>",""`) || !strings.Contains(lines[2], `,"12.3","","","0.25","",""`) {
+		t.Errorf("row = %s", lines[2])
+	}
+}
 
+func TestEvaluationErrorsCSV(t *testing.T) {
+	list := []EvaluationError{{ResourceID: "/subscriptions/sub/vm2", Name: `vm2,"prod"`, Err: errors.New("throttled, retry later")}}
+	var b bytes.Buffer
+	if err := renderTemplate(&b, list, &ReportInfo{}, "evaluationerrors.tmpl.csv"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	// カンマや引用符を含む名前でも列がずれないこと
+	if len(lines) != 2 || lines[1] != `"/subscriptions/sub/vm2","vm2,""prod""","throttled, retry later"` {
+		t.Errorf("CSV = %s", b.String())
+	}
 }
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/urfave/cli/v2"
+)
+
+// recordFlags returns global flags for record and replay
+func recordFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "record",
+			Usage: "record Resource Graph and Metrics API traffic to the directory. Subscription IDs and other GUIDs are scrubbed",
+		},
+		&cli.StringFlag{
+			Name:  "replay",
+			Usage: "replay the traffic recorded with --record from the directory without network access",
+		},
+	}
+}
+
+// recordManifestFile is the file name of the manifest of a recording
+const recordManifestFile = "manifest.json"
+
+// RecordManifest is settings of the recorded run which are needed to replay it
+type RecordManifest struct {
+	SubscriptionIDs []string `json:"subscriptionIds"`
+	MetricsBatch    bool     `json:"metricsBatch"`
+	// ResourceManagerEndpoint is the endpoint of the recorded run, which is empty in recordings of older versions
+	ResourceManagerEndpoint string `json:"resourceManagerEndpoint,omitempty"`
+	MetricsBatchEndpoint    string `json:"metricsBatchEndpoint,omitempty"`
+}
+
+// RecordedExchange is a recorded pair of request and response
+type RecordedExchange struct {
+	Request struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+		Body   string `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		StatusCode int         `json:"statusCode"`
+		Header     http.Header `json:"header,omitempty"`
+		Body       string      `json:"body,omitempty"`
+	} `json:"response"`
+}
+
+// recordedHeaders is response headers kept in a recording. Other headers are dropped not to leak secrets.
+var recordedHeaders = []string{
+	"Content-Type",
+	"Retry-After",
+	headerQuotaRemaining,
+	headerQuotaResetsAfter,
+}
+
+// volatileQueryParameters is query parameters which depend on the time of the run and are ignored on replay
+var volatileQueryParameters = map[string]bool{
+	"timespan":  true,
+	"starttime": true,
+	"endtime":   true,
+}
+
+var guidPattern = regexp.MustCompile(`(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+
+// Recorder records requests and responses to a directory
+type Recorder struct {
+	dir      string
+	mutex    sync.Mutex
+	count    int
+	scrubbed map[string]string
+}
+
+// NewRecorder returns *Recorder which writes to dir
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Recorder{dir: dir, scrubbed: map[string]string{}}, nil
+}
+
+// scrub replaces GUIDs such as subscription IDs with placeholders.
+// The same GUID is always replaced with the same placeholder so that the recording stays consistent.
+func (r *Recorder) scrub(s string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return guidPattern.ReplaceAllStringFunc(s, func(guid string) string {
+		key := strings.ToLower(guid)
+		if v, ok := r.scrubbed[key]; ok {
+			return v
+		}
+		v := fmt.Sprintf("00000000-0000-0000-0000-%012d", len(r.scrubbed)+1)
+		r.scrubbed[key] = v
+		return v
+	})
+}
+
+// WriteManifest writes the scrubbed settings of the client
+func (r *Recorder) WriteManifest(client *Client) error {
+	// 記録したリクエストはホストも含めて照合するため、再生時に同じエンドポイントを使う
+	manifest := RecordManifest{
+		MetricsBatch:            client.MetricsBatchClient != nil,
+		ResourceManagerEndpoint: client.ResourceGraphClient.BaseURI,
+	}
+	if client.MetricsBatchClient != nil {
+		manifest.MetricsBatchEndpoint = client.MetricsBatchClient.Endpoint
+	}
+	for _, id := range client.SubscriptionIDs {
+		manifest.SubscriptionIDs = append(manifest.SubscriptionIDs, r.scrub(id))
+	}
+	return writeJSONFile(filepath.Join(r.dir, recordManifestFile), manifest)
+}
+
+// Sender returns autorest.Sender which records the traffic sent with next
+func (r *Recorder) Sender(next autorest.Sender) autorest.Sender {
+	return autorest.SenderFunc(func(req *http.Request) (*http.Response, error) {
+		var reqBody []byte
+		if req.Body != nil {
+			b, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			req.Body.Close()
+			reqBody = b
+			req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		}
+
+		resp, err := next.Do(req)
+		// 通信エラーは記録しない
+		if err != nil || resp == nil {
+			return resp, err
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+		var e RecordedExchange
+		e.Request.Method = req.Method
+		e.Request.URL = r.scrub(req.URL.String())
+		e.Request.Body = r.scrub(string(reqBody))
+		e.Response.StatusCode = resp.StatusCode
+		for _, h := range recordedHeaders {
+			if v := resp.Header.Get(h); v != "" {
+				if e.Response.Header == nil {
+					e.Response.Header = http.Header{}
+				}
+				e.Response.Header.Set(h, v)
+			}
+		}
+		e.Response.Body = r.scrub(string(respBody))
+
+		r.mutex.Lock()
+		r.count++
+		name := fmt.Sprintf("%06d.json", r.count)
+		r.mutex.Unlock()
+		if err := writeJSONFile(filepath.Join(r.dir, name), e); err != nil {
+			logger.Warn("failed to record the response", "method", req.Method, "path", req.URL.Path, "error", err)
+		}
+		return resp, nil
+	})
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// exchangeKey returns the key to match a request with the recording.
+// Query parameters which depend on the time of the run are ignored.
+func exchangeKey(method string, rawURL string, body string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for k := range query {
+		if volatileQueryParameters[strings.ToLower(k)] {
+			query.Del(k)
+		}
+	}
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		params = append(params, k+"="+strings.Join(query[k], ","))
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s%s?%s\n%s", method, strings.ToLower(u.Host), strings.ToLower(u.EscapedPath()), strings.Join(params, "&"), body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ReplayMissError is returned for a request which is not in the recording.
+// It is not retried since the recording does not change.
+type ReplayMissError struct {
+	Method string
+	URL    string
+}
+
+func (e *ReplayMissError) Error() string {
+	return fmt.Sprintf("no recorded response for %s %s", e.Method, e.URL)
+}
+
+// Replayer serves the recorded responses
+type Replayer struct {
+	mutex     sync.Mutex
+	exchanges map[string][]RecordedExchange
+	served    map[string]int
+}
+
+// NewReplayer loads the recording in dir
+func NewReplayer(dir string) (*Replayer, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "[0-9]*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	r := &Replayer{exchanges: map[string][]RecordedExchange{}, served: map[string]int{}}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var e RecordedExchange
+		if err := json.Unmarshal(b, &e); err != nil {
+			return nil, fmt.Errorf("invalid recording %s: %v", f, err)
+		}
+		key, err := exchangeKey(e.Request.Method, e.Request.URL, e.Request.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recording %s: %v", f, err)
+		}
+		r.exchanges[key] = append(r.exchanges[key], e)
+	}
+	return r, nil
+}
+
+// Do returns the recorded response of the request.
+// Identical requests are served in the recorded order, and the last response is repeated after that.
+func (r *Replayer) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		body = b
+	}
+	key, err := exchangeKey(req.Method, req.URL.String(), string(body))
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	exchanges := r.exchanges[key]
+	i := r.served[key]
+	if i < len(exchanges)-1 {
+		r.served[key]++
+	}
+	r.mutex.Unlock()
+	if len(exchanges) == 0 {
+		return nil, &ReplayMissError{Method: req.Method, URL: req.URL.String()}
+	}
+
+	e := exchanges[i]
+	header := http.Header{}
+	for k, v := range e.Response.Header {
+		header[k] = v
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Response.StatusCode, http.StatusText(e.Response.StatusCode)),
+		StatusCode:    e.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(e.Response.Body)),
+		ContentLength: int64(len(e.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// NewReplayClient returns *Client which serves the recording in dir without network access
+func NewReplayClient(dir string) (*Client, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, recordManifestFile))
+	if err != nil {
+		return &Client{}, fmt.Errorf("not a recording directory: %v", err)
+	}
+	var manifest RecordManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return &Client{}, fmt.Errorf("invalid manifest of the recording: %v", err)
+	}
+	replayer, err := NewReplayer(dir)
+	if err != nil {
+		return &Client{}, err
+	}
+
+	// 記録には認証情報が含まれないため認証しない
+	options := &ClientOptions{Sender: replayer, ResourceManagerEndpoint: manifest.ResourceManagerEndpoint}
+	client := newClient(manifest.SubscriptionIDs, autorest.NullAuthorizer{}, options)
+	if manifest.MetricsBatch {
+		client.MetricsBatchClient = NewMetricsBatchClient(autorest.NullAuthorizer{})
+		if manifest.MetricsBatchEndpoint != "" {
+			client.MetricsBatchClient.Endpoint = manifest.MetricsBatchEndpoint
+		}
+		client.MetricsBatchClient.Sender = replayer
+	}
+	client.RetryPolicy.NoDelay = true
+	logger.Info("replaying the recording", "dir", dir, "subscriptions", manifest.SubscriptionIDs)
+	return client, nil
+}
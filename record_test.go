@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	const subscriptionID = "9f2b6c1e-3a4d-4e5f-8a9b-0c1d2e3f4a5b"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Write([]byte(`{"totalRecords":1,"count":1,"data":[{"id":"/subscriptions/` + subscriptionID + `/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm","subscriptionId":"` + subscriptionID + `"}]}`))
+	}))
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	recorder, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer := autorest.NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{"Authorization": "Bearer secret-token"})
+	client := newClient([]string{subscriptionID}, authorizer, &ClientOptions{Sender: recorder.Sender(autorest.CreateSender())})
+	client.ResourceGraphClient.BaseURI = server.URL
+	if err := recorder.WriteManifest(client); err != nil {
+		t.Fatal(err)
+	}
+	params := ResourceGraphQueryRequestInput{subscriptionIDs: client.SubscriptionIDs, query: "resources"}
+	if _, err := client.QueryResources(context.Background(), params, &rawRows{}); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 2 {
+		t.Fatalf("recorded files = %v, want manifest and 1 exchange", files)
+	}
+	for _, f := range files {
+		b, _ := ioutil.ReadFile(f)
+		for _, secret := range []string{subscriptionID, "secret-token", "session=secret"} {
+			if strings.Contains(string(b), secret) {
+				t.Errorf("%s contains %q", f, secret)
+			}
+		}
+	}
+
+	// サーバーを停止した状態で再生する
+	replay, err := NewReplayClient(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 記録したエンドポイントに送信されること
+	if replay.ResourceGraphClient.BaseURI != server.URL {
+		t.Errorf("replay endpoint = %s, want %s", replay.ResourceGraphClient.BaseURI, server.URL)
+	}
+	params.subscriptionIDs = replay.SubscriptionIDs
+	var rows rawRows
+	if _, err := replay.QueryResources(context.Background(), params, &rows); err != nil {
+		t.Fatal(err)
+	}
+	var row map[string]interface{}
+	if err := json.Unmarshal(rows[0], &row); err != nil {
+		t.Fatal(err)
+	}
+	if row["subscriptionId"] != replay.SubscriptionIDs[0] || !strings.Contains(row["id"].(string), replay.SubscriptionIDs[0]) {
+		t.Errorf("replayed row = %v, want scrubbed subscription %s", row, replay.SubscriptionIDs[0])
+	}
+
+	params.query = "resources | where type == 'other'"
+	replay.RetryStats = &RetryStats{}
+	if _, err := replay.QueryResources(context.Background(), params, &rawRows{}); err == nil || !strings.Contains(err.Error(), "no recorded response") {
+		t.Errorf("unrecorded request should fail: %v", err)
+	}
+	if replay.RetryStats.Retries != 0 {
+		t.Errorf("unrecorded request was retried: %s", replay.RetryStats.Summary())
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcegraph/mgmt/2019-04-01/resourcegraph"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// ResourceGraphRows is a typed slice which rows of Resource Graph are decoded into, such as *Disks
+type ResourceGraphRows interface {
+	// AppendRow decodes the JSON object of a row and appends it
+	AppendRow(row []byte) error
+	// Len returns the number of rows
+	Len() int
+	// Truncate drops the rows after the first n, so that rows appended before a failure can be discarded
+	Truncate(n int)
+}
+
+// rawRows keeps rows as JSON without decoding
+type rawRows []json.RawMessage
+
+// AppendRow appends a copy of the row
+func (r *rawRows) AppendRow(row []byte) error {
+	*r = append(*r, append(json.RawMessage{}, row...))
+	return nil
+}
+
+// Len returns the number of rows
+func (r *rawRows) Len() int { return len(*r) }
+
+// Truncate drops the rows after the first n
+func (r *rawRows) Truncate(n int) { *r = (*r)[:n] }
+
+// ResourceGraphRowError is an error of decoding a row of Resource Graph
+type ResourceGraphRowError struct {
+	// Row is the index of the row in the result
+	Row int
+	// ID is the resource ID of the row if it has
+	ID string
+	// Field is the path of the field which could not be decoded
+	Field string
+	Err   error
+}
+
+func (e *ResourceGraphRowError) Error() string {
+	msg := fmt.Sprintf("failed to decode row %d", e.Row)
+	if e.ID != "" {
+		msg += fmt.Sprintf(" (id: %s)", e.ID)
+	}
+	if e.Field != "" {
+		msg += fmt.Sprintf(" at field %s", e.Field)
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+// appendResourceGraphRow appends the row to rows and returns *ResourceGraphRowError on failure
+func appendResourceGraphRow(rows ResourceGraphRows, index int, row []byte) error {
+	err := rows.AppendRow(row)
+	if err == nil {
+		return nil
+	}
+	e := &ResourceGraphRowError{Row: index, Err: err}
+	var id struct {
+		ID string `json:"id"`
+	}
+	// ID はエラーメッセージのためだけに読み込む
+	if json.Unmarshal(row, &id) == nil {
+		e.ID = id.ID
+	}
+	if te, ok := err.(*json.UnmarshalTypeError); ok {
+		e.Field = te.Field
+		e.Err = fmt.Errorf("cannot decode JSON %s into %s", te.Value, te.Type)
+	}
+	return e
+}
+
+// ResourceGraphQueryStats is record counts of a Resource Graph query
+type ResourceGraphQueryStats struct {
+	TotalRecords int64
+	Returned     int64
+	Truncated    bool
+}
+
+// resourceGraphPageSize is the maximum number of rows per page of Resource Graph
+const resourceGraphPageSize int32 = 1000
+
+// resourceGraphPage is the properties of a page of Resource Graph other than the rows
+type resourceGraphPage struct {
+	TotalRecords    int64
+	Count           int64
+	ResultTruncated string
+	SkipToken       string
+	// Rows is the number of rows decoded from the page
+	Rows int
+}
+
+// expectDelim reads the JSON delimiter from dec
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected %q but got %v", delim, t)
+	}
+	return nil
+}
+
+// decodeResourceGraphPage decodes the response of Resource Graph and appends each row in data to rows without
+// keeping the whole response. offset is the index of the first row of the page.
+func decodeResourceGraphPage(r io.Reader, rows ResourceGraphRows, offset int) (resourceGraphPage, error) {
+	var page resourceGraphPage
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return page, err
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return page, err
+		}
+		var v interface{}
+		switch t {
+		case "data":
+			if err := expectDelim(dec, '['); err != nil {
+				return page, fmt.Errorf("data is not an array of objects: %v", err)
+			}
+			for i := offset; dec.More(); i++ {
+				var row json.RawMessage
+				if err := dec.Decode(&row); err != nil {
+					return page, err
+				}
+				if err := appendResourceGraphRow(rows, i, row); err != nil {
+					return page, err
+				}
+				page.Rows++
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				return page, err
+			}
+			continue
+		case "totalRecords":
+			v = &page.TotalRecords
+		case "count":
+			v = &page.Count
+		case "resultTruncated":
+			v = &page.ResultTruncated
+		case "$skipToken":
+			v = &page.SkipToken
+		default:
+			// facets などは読み飛ばす
+			v = &json.RawMessage{}
+		}
+		if err := dec.Decode(v); err != nil {
+			return page, fmt.Errorf("invalid %v: %v", t, err)
+		}
+	}
+	return page, expectDelim(dec, '}')
+}
+
+// FetchResourceGraphRows fetches all pages of the query with $skipToken and decodes the rows into rows
+func FetchResourceGraphRows(c context.Context, client *Client, params ResourceGraphQueryRequestInput, rows ResourceGraphRows) (ResourceGraphQueryStats, error) {
+	var stats ResourceGraphQueryStats
+
+	var facetRequest []resourcegraph.FacetRequest
+	for i := 0; i < len(params.facets); i++ {
+		facetRequest = append(
+			facetRequest,
+			resourcegraph.FacetRequest{
+				Expression: &params.facets[i],
+			},
+		)
+	}
+	request := &resourcegraph.QueryRequest{
+		Subscriptions: &params.subscriptionIDs,
+		Query:         &params.query,
+		Options: &resourcegraph.QueryRequestOptions{
+			ResultFormat: resourcegraph.ResultFormatObjectArray,
+			Top:          to.Int32Ptr(resourceGraphPageSize),
+		},
+		Facets: &facetRequest,
+	}
+
+	rg := client.ResourceGraphClient
+	for {
+		// SDK の Resources はレスポンス全体を interface{} に読み込むため、送信だけ SDK で行いボディは逐次読み込む
+		req, err := rg.ResourcesPreparer(client.withRetry(c, client.ResourceGraphLimiter), *request)
+		if err != nil {
+			return stats, autorest.NewErrorWithError(err, "resourcegraph.BaseClient", "Resources", nil, "Failure preparing request")
+		}
+		resp, err := rg.ResourcesSender(req)
+		if err != nil {
+			return stats, autorest.NewErrorWithError(err, "resourcegraph.BaseClient", "Resources", resp, "Failure sending request")
+		}
+		if err := autorest.Respond(resp, rg.ByInspecting(), azure.WithErrorUnlessStatusCode(http.StatusOK)); err != nil {
+			autorest.Respond(resp, autorest.ByDiscardingBody(), autorest.ByClosing())
+			return stats, autorest.NewErrorWithError(err, "resourcegraph.BaseClient", "Resources", resp, "Failure responding to request")
+		}
+		page, err := decodeResourceGraphPage(resp.Body, rows, int(stats.Returned))
+		resp.Body.Close()
+		if err != nil {
+			return stats, err
+		}
+
+		stats.TotalRecords = page.TotalRecords
+		stats.Returned += int64(page.Rows)
+		if page.ResultTruncated == string(resourcegraph.True) {
+			stats.Truncated = true
+		}
+		if page.SkipToken == "" {
+			break
+		}
+		// 2ページ目以降は $skipToken でページ位置を指定する
+		request.Options.SkipToken = &page.SkipToken
+		request.Facets = nil
+	}
+	if stats.Returned < stats.TotalRecords {
+		stats.Truncated = true
+	}
+
+	return stats, nil
+}
+
+// QueryResources fetches all pages of the query from Resource Graph
+func (c *Client) QueryResources(ctx context.Context, params ResourceGraphQueryRequestInput, rows ResourceGraphRows) (ResourceGraphQueryStats, error) {
+	return FetchResourceGraphRows(ctx, c, params, rows)
+}
+
+// FetchResourceGraphData fetches all rows of the query into rows, such as *Disks
+func FetchResourceGraphData(c context.Context, inventory ResourceInventory, params ResourceGraphQueryRequestInput, rows ResourceGraphRows) error {
+	stats, err := inventory.QueryResources(c, params, rows)
+	if err != nil {
+		return err
+	}
+	logger.Debug("Resource Graph query returned", "returned", stats.Returned, "total", stats.TotalRecords)
+	if stats.Truncated {
+		logger.Warn("Resource Graph result was truncated", "returned", stats.Returned, "total", stats.TotalRecords, "query", params.query)
+	}
+	return nil
+}
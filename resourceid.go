@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ResourceID is a parsed ARM resource ID such as
+// /subscriptions/{id}/resourceGroups/{group}/providers/Microsoft.Sql/servers/{server}/databases/{database}
+type ResourceID struct {
+	SubscriptionID string
+	// ResourceGroup is empty for resources at the subscription scope
+	ResourceGroup string
+	// Provider is the namespace of the resource provider such as Microsoft.Sql
+	Provider string
+	// Types is the type chain from the top-level resource such as [servers databases]
+	Types []string
+	// Names is the name of each type in Types such as [server1 db1]
+	Names []string
+	// raw is the ID as parsed, which is sent to Azure Monitor as it is
+	raw string
+}
+
+// ParseResourceID parses the resource ID including child resources.
+// For extension resources which have another providers segment,
+// Provider, Types and Names are of the extension resource.
+func ParseResourceID(id string) (ResourceID, error) {
+	r := ResourceID{raw: id}
+	segments := strings.Split(strings.TrimPrefix(id, "/"), "/")
+	if !strings.HasPrefix(id, "/") || len(segments) < 4 || !strings.EqualFold(segments[0], "subscriptions") {
+		return r, fmt.Errorf("invalid resource ID %q: must start with /subscriptions/{subscriptionId}", id)
+	}
+	for _, s := range segments {
+		if s == "" {
+			return r, fmt.Errorf("invalid resource ID %q: empty segment", id)
+		}
+	}
+	r.SubscriptionID = segments[1]
+	rest := segments[2:]
+	if strings.EqualFold(rest[0], "resourceGroups") {
+		if len(rest) < 2 {
+			return r, fmt.Errorf("invalid resource ID %q: no resource group name", id)
+		}
+		r.ResourceGroup = rest[1]
+		rest = rest[2:]
+	}
+	if len(rest) < 4 || !strings.EqualFold(rest[0], "providers") {
+		return r, fmt.Errorf("invalid resource ID %q: no resource provider and type", id)
+	}
+	// プロバイダーの後は種類と名前の組が子リソースの分だけ続く
+	if len(rest)%2 != 0 {
+		return r, fmt.Errorf("invalid resource ID %q: resource type %s has no name", id, rest[len(rest)-1])
+	}
+	for i := 0; i < len(rest); i += 2 {
+		if strings.EqualFold(rest[i], "providers") {
+			// 拡張リソースは最後のプロバイダー以降を種類とする
+			r.Provider = rest[i+1]
+			r.Types, r.Names = nil, nil
+			continue
+		}
+		r.Types = append(r.Types, rest[i])
+		r.Names = append(r.Names, rest[i+1])
+	}
+	if len(r.Types) == 0 {
+		return r, fmt.Errorf("invalid resource ID %q: no resource type after provider %s", id, r.Provider)
+	}
+	return r, nil
+}
+
+// Type returns the full resource type such as Microsoft.Sql/servers/databases
+func (r ResourceID) Type() string {
+	return strings.Join(append([]string{r.Provider}, r.Types...), "/")
+}
+
+// Name returns the name of the resource, which is the last name of the type chain
+func (r ResourceID) Name() string {
+	if len(r.Names) == 0 {
+		return ""
+	}
+	return r.Names[len(r.Names)-1]
+}
+
+// String returns the resource ID as parsed, or the ID built from the fields
+func (r ResourceID) String() string {
+	if r.raw != "" {
+		return r.raw
+	}
+	var sb strings.Builder
+	sb.WriteString("/subscriptions/" + r.SubscriptionID)
+	if r.ResourceGroup != "" {
+		sb.WriteString("/resourceGroups/" + r.ResourceGroup)
+	}
+	sb.WriteString("/providers/" + r.Provider)
+	for i := range r.Types {
+		sb.WriteString("/" + r.Types[i] + "/" + r.Names[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestParseResourceID(t *testing.T) {
+	tests := []struct {
+		id    string
+		group string
+		typ   string
+		name  string
+	}{
+		{"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1", "rg", "Microsoft.Compute/virtualMachines", "vm1"},
+		{"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Sql/servers/sql1/databases/db1", "rg", "Microsoft.Sql/servers/databases", "db1"},
+		{"/subscriptions/sub/resourcegroups/rg/providers/Microsoft.Storage/storageAccounts/st1/blobServices/default", "rg", "Microsoft.Storage/storageAccounts/blobServices", "default"},
+		{"/subscriptions/sub/providers/Microsoft.Web/certificates/cert1", "", "Microsoft.Web/certificates", "cert1"},
+		{"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1/providers/Microsoft.Insights/diagnosticSettings/d", "rg", "Microsoft.Insights/diagnosticSettings", "d"},
+	}
+	for _, tt := range tests {
+		r, err := ParseResourceID(tt.id)
+		if err != nil {
+			t.Errorf("ParseResourceID(%s): %v", tt.id, err)
+			continue
+		}
+		// 返す ID は大文字小文字も含めて解析した文字列のまま
+		if r.SubscriptionID != "sub" || r.ResourceGroup != tt.group || r.Type() != tt.typ || r.Name() != tt.name || r.String() != tt.id {
+			t.Errorf("ParseResourceID(%s) = %+v", tt.id, r)
+		}
+	}
+
+	r, _ := ParseResourceID(tests[1].id)
+	if r.Provider != "Microsoft.Sql" || len(r.Types) != 2 || r.Names[0] != "sql1" {
+		t.Errorf("child resource = %+v", r)
+	}
+	built := ResourceID{SubscriptionID: "sub", ResourceGroup: "rg", Provider: "Microsoft.Sql", Types: r.Types, Names: r.Names}
+	if built.String() != tests[1].id {
+		t.Errorf("built ID = %s", built.String())
+	}
+
+	for _, id := range []string{
+		"",
+		"subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1",
+		"/subscriptions/sub/resourceGroups/rg",
+		"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines",
+		"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1/",
+		"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1/providers/Microsoft.Insights",
+	} {
+		if _, err := ParseResourceID(id); err == nil {
+			t.Errorf("ParseResourceID(%q): no error", id)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/urfave/cli/v2"
+)
+
+// RetryPolicy is policy of retry for throttled or failed requests
+type RetryPolicy struct {
+	MaxAttempts    int
+	BaseDelay      time.Duration
+	MaxDelay       time.Duration
+	RequestTimeout time.Duration
+	// NoDelay retries without waiting. It is used for replay so that recorded throttling does not wait.
+	NoDelay bool
+}
+
+// DefaultRetryPolicy is used when no retry flag is specified
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	BaseDelay:      2 * time.Second,
+	MaxDelay:       2 * time.Minute,
+	RequestTimeout: DefaultRequestTimeout,
+}
+
+// RetryStats is counters of API calls and retries in a run
+type RetryStats struct {
+	mutex   sync.Mutex
+	Calls   int
+	Retried int
+	Retries int
+	Failed  int
+}
+
+func (s *RetryStats) record(attempts int, failed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Calls++
+	if attempts > 1 {
+		s.Retried++
+		s.Retries += attempts - 1
+	}
+	if failed {
+		s.Failed++
+	}
+}
+
+// Summary returns a line describing the retried calls
+func (s *RetryStats) Summary() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return fmt.Sprintf("API calls: %d, retried calls: %d, retries: %d, failed after retry: %d", s.Calls, s.Retried, s.Retries, s.Failed)
+}
+
+// Log logs the summary of the retried calls
+func (s *RetryStats) Log() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	logger.Info("API call summary", "calls", s.Calls, "retriedCalls", s.Retried, "retries", s.Retries, "failedAfterRetry", s.Failed)
+}
+
+// retryFlags returns global flags for retry
+func retryFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:  "maxRetryAttempts",
+			Value: DefaultRetryPolicy.MaxAttempts,
+			Usage: "maximum number of attempts for throttled (429) or failed (5xx) API calls",
+		},
+	}
+}
+
+// Headers of Resource Graph which describe the user quota
+const (
+	headerQuotaRemaining   = "x-ms-user-quota-remaining"
+	headerQuotaResetsAfter = "x-ms-user-quota-resets-after"
+)
+
+// shouldRetry returns true when the response is throttled or a transient failure
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		// 認証エラーや記録にないリクエストは再試行しても成功しない
+		if _, ok := err.(*ReplayMissError); ok {
+			return false
+		}
+		return !autorest.IsTokenRefreshError(err)
+	}
+	return autorest.ResponseHasStatusCode(resp, autorest.StatusCodesForRetry...)
+}
+
+// delay returns the wait duration before the next attempt.
+// Retry-After and the quota headers take precedence over the exponential backoff when they are longer.
+func (p RetryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+	if p.NoDelay {
+		return 0
+	}
+	d := p.BaseDelay << uint(attempt-1)
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	// 待ち時間の半分をランダムにして、再試行が同時に集中しないようにする
+	if half := int64(d / 2); half > 0 {
+		d = time.Duration(half + rand.Int63n(half))
+	}
+
+	if resp == nil {
+		return d
+	}
+	if ra := retryAfter(resp.Header); ra > d {
+		d = ra
+	}
+	if resp.Header.Get(headerQuotaRemaining) == "0" {
+		if ra := parseQuotaResetsAfter(resp.Header.Get(headerQuotaResetsAfter)); ra > d {
+			d = ra
+		}
+	}
+	return d
+}
+
+// retryAfter parses the Retry-After header which is seconds or a date
+func retryAfter(h http.Header) time.Duration {
+	ra := h.Get("Retry-After")
+	if ra == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(ra); err == nil {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(ra); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// parseQuotaResetsAfter parses x-ms-user-quota-resets-after formatted as hh:mm:ss
+func parseQuotaResetsAfter(v string) time.Duration {
+	parts := strings.Split(v, ":")
+	if len(parts) != 3 {
+		return 0
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		n, err := strconv.ParseFloat(parts[i], 64)
+		if err != nil {
+			return 0
+		}
+		d += time.Duration(n * float64(unit))
+	}
+	return d
+}
+
+// cancelOnClose cancels the context of the request when the response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// doWithTimeout sends the request with RequestTimeout of the policy
+func (p RetryPolicy) doWithTimeout(s autorest.Sender, r *http.Request) (*http.Response, error) {
+	if p.RequestTimeout <= 0 {
+		return s.Do(r)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), p.RequestTimeout)
+	resp, err := s.Do(r.WithContext(ctx))
+	if resp == nil || resp.Body == nil {
+		cancel()
+		return resp, err
+	}
+	// レスポンスボディは呼び出し元で読み込まれるため、閉じられるまでキャンセルしない
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, err
+}
+
+// doRetryWithBackoff returns a SendDecorator which retries throttled or failed requests with exponential backoff
+func doRetryWithBackoff(policy RetryPolicy, stats *RetryStats) autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			rr := autorest.NewRetriableRequest(r)
+			for attempt := 1; ; attempt++ {
+				if err := rr.Prepare(); err != nil {
+					stats.record(attempt, true)
+					return nil, err
+				}
+				resp, err := policy.doWithTimeout(s, rr.Request())
+				if !shouldRetry(resp, err) {
+					stats.record(attempt, false)
+					return resp, err
+				}
+				// 実行全体がキャンセルされた場合は再試行しない
+				if r.Context().Err() != nil {
+					stats.record(attempt, true)
+					return resp, err
+				}
+				if attempt >= policy.MaxAttempts {
+					stats.record(attempt, true)
+					return resp, err
+				}
+
+				d := policy.delay(attempt, resp)
+				autorest.DrainResponseBody(resp)
+				select {
+				case <-time.After(d):
+				case <-r.Context().Done():
+					stats.record(attempt, true)
+					return nil, r.Context().Err()
+				}
+			}
+		})
+	}
+}
+
+// withRetry replaces the default retry of the SDK with RetryPolicy of the client.
+// Each attempt is sent in a slot of the limiter of the API.
+func (c *Client) withRetry(ctx context.Context, limiter *Limiter) context.Context {
+	return autorest.WithSendDecorators(ctx, []autorest.SendDecorator{withLimit(limiter), doRetryWithBackoff(c.RetryPolicy, c.RetryStats)})
+}
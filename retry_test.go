@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+func TestDoRetryWithBackoff(t *testing.T) {
+	var calls int
+	sender := autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		rec := httptest.NewRecorder()
+		if calls < 3 {
+			rec.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			rec.WriteHeader(http.StatusOK)
+		}
+		return rec.Result(), nil
+	})
+
+	stats := &RetryStats{}
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	resp, err := autorest.DecorateSender(sender, doRetryWithBackoff(policy, stats)).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || calls != 3 {
+		t.Errorf("status = %d, calls = %d", resp.StatusCode, calls)
+	}
+	if stats.Calls != 1 || stats.Retried != 1 || stats.Retries != 2 || stats.Failed != 0 {
+		t.Errorf("unexpected stats: %s", stats.Summary())
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Retry-After", "3")
+	if d := policy.delay(1, resp); d != 3*time.Second {
+		t.Errorf("Retry-After: delay = %s", d)
+	}
+
+	resp = &http.Response{Header: http.Header{}}
+	resp.Header.Set(headerQuotaRemaining, "0")
+	resp.Header.Set(headerQuotaResetsAfter, "00:00:05")
+	if d := policy.delay(1, resp); d != 5*time.Second {
+		t.Errorf("quota: delay = %s", d)
+	}
+
+	if d := policy.delay(20, nil); d < policy.MaxDelay/2 || d > policy.MaxDelay {
+		t.Errorf("backoff: delay = %s", d)
+	}
+}
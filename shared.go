@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
+)
+
+// sharedInventory is ResourceInventory which keeps the results of queries,
+// so that checks of a run listing the same resources such as VMs query Resource Graph once.
+type sharedInventory struct {
+	ResourceInventory
+	mutex   sync.Mutex
+	results map[string]sharedQueryResult
+}
+
+type sharedQueryResult struct {
+	rows  rawRows
+	stats ResourceGraphQueryStats
+}
+
+// newSharedInventory returns *sharedInventory which queries inventory
+func newSharedInventory(inventory ResourceInventory) *sharedInventory {
+	return &sharedInventory{ResourceInventory: inventory, results: map[string]sharedQueryResult{}}
+}
+
+// QueryResources returns the rows of the same query from the previous result
+func (s *sharedInventory) QueryResources(ctx context.Context, params ResourceGraphQueryRequestInput, rows ResourceGraphRows) (ResourceGraphQueryStats, error) {
+	key := strings.Join([]string{strings.Join(params.subscriptionIDs, ","), strings.Join(params.facets, ","), params.query}, "\n")
+	s.mutex.Lock()
+	result, ok := s.results[key]
+	s.mutex.Unlock()
+
+	if !ok {
+		stats, err := s.ResourceInventory.QueryResources(ctx, params, &result.rows)
+		if err != nil {
+			// 失敗した結果は共有しない
+			return stats, err
+		}
+		result.stats = stats
+		s.mutex.Lock()
+		s.results[key] = result
+		s.mutex.Unlock()
+	} else {
+		logger.Debug("reusing Resource Graph result", "rows", len(result.rows))
+	}
+
+	for i, row := range result.rows {
+		if err := appendResourceGraphRow(rows, i, row); err != nil {
+			return result.stats, err
+		}
+	}
+	return result.stats, nil
+}
+
+// sharedMetrics is MetricsSource which keeps the metrics of each resource,
+// so that checks of a run evaluating the same resources with the same query fetch the metrics once.
+type sharedMetrics struct {
+	MetricsSource
+	mutex       sync.Mutex
+	results     map[string]TargetMetrics
+	definitions map[string][]insights.MetricDefinition
+}
+
+// newSharedMetrics returns *sharedMetrics which fetches metrics from source
+func newSharedMetrics(source MetricsSource) *sharedMetrics {
+	return &sharedMetrics{
+		MetricsSource: source,
+		results:       map[string]TargetMetrics{},
+		definitions:   map[string][]insights.MetricDefinition{},
+	}
+}
+
+// sharedMetricsKey returns the key of the metrics of the resource fetched with the query
+func sharedMetricsKey(resourceID string, query MetricQuery) string {
+	return strings.ToLower(strings.Join([]string{resourceID, strings.Join(query.MetricNames, ","), strings.Join(query.Aggregations, ",")}, "\n"))
+}
+
+// FetchMetrics fetches the metrics of the targets which have not been fetched with the query
+func (s *sharedMetrics) FetchMetrics(ctx context.Context, targets []MetricTarget, query MetricQuery) []TargetMetrics {
+	var results []TargetMetrics
+	var missing []MetricTarget
+	var missingIndex []int
+	s.mutex.Lock()
+	for i, t := range targets {
+		if r, ok := s.results[sharedMetricsKey(t.ID, query)]; ok {
+			r.Index = i
+			results = append(results, r)
+			continue
+		}
+		missing = append(missing, t)
+		missingIndex = append(missingIndex, i)
+	}
+	s.mutex.Unlock()
+	if len(missing) == 0 {
+		return results
+	}
+
+	fetched := s.MetricsSource.FetchMetrics(ctx, missing, query)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, r := range fetched {
+		r.Index = missingIndex[r.Index]
+		// 取得できなかったリソースもエラーを共有し、同じリソースを再度問い合わせない
+		s.results[sharedMetricsKey(targets[r.Index].ID, query)] = r
+		results = append(results, r)
+	}
+	return results
+}
+
+// MetricDefinitions returns the metric definitions of the resource fetched once
+func (s *sharedMetrics) MetricDefinitions(ctx context.Context, resourceID string) ([]insights.MetricDefinition, error) {
+	key := strings.ToLower(resourceID)
+	s.mutex.Lock()
+	defs, ok := s.definitions[key]
+	s.mutex.Unlock()
+	if ok {
+		return defs, nil
+	}
+	defs, err := s.MetricsSource.MetricDefinitions(ctx, resourceID)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.definitions[key] = defs
+	s.mutex.Unlock()
+	return defs, nil
+}
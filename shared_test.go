@@ -0,0 +1,83 @@
+//go:build !release
+// +build !release
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
+)
+
+// countingBackend counts queries and fetched metrics of FakeBackend
+type countingBackend struct {
+	*FakeBackend
+	mutex   sync.Mutex
+	queries map[string]int
+	metrics map[string]int
+}
+
+func (b *countingBackend) QueryResources(ctx context.Context, params ResourceGraphQueryRequestInput, rows ResourceGraphRows) (ResourceGraphQueryStats, error) {
+	b.mutex.Lock()
+	b.queries[params.query]++
+	b.mutex.Unlock()
+	return b.FakeBackend.QueryResources(ctx, params, rows)
+}
+
+func (b *countingBackend) FetchMetrics(ctx context.Context, targets []MetricTarget, query MetricQuery) []TargetMetrics {
+	b.mutex.Lock()
+	for _, t := range targets {
+		b.metrics[t.ID]++
+	}
+	b.mutex.Unlock()
+	return b.FakeBackend.FetchMetrics(ctx, targets, query)
+}
+
+func (b *countingBackend) MetricDefinitions(ctx context.Context, resourceID string) ([]insights.MetricDefinition, error) {
+	return b.FakeBackend.MetricDefinitions(ctx, resourceID)
+}
+
+func TestSharedChecks(t *testing.T) {
+	backend := &countingBackend{FakeBackend: newFakeVMBackend(), queries: map[string]int{}, metrics: map[string]int{}}
+	env := &CheckEnv{
+		Inventory:       newSharedInventory(backend),
+		Metrics:         newSharedMetrics(backend),
+		SubscriptionIDs: []string{"sub"},
+		Errors:          NewEvaluationErrors(false),
+	}
+	counts := map[string]int{}
+	for _, check := range []Check{diskCheck{}, vmCheck{}} {
+		findings, err := runCheck(context.Background(), check, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range findings {
+			counts[f.Category]++
+		}
+	}
+	// 共有した結果でも各チェックの検出結果は単独で実行した場合と同じになること
+	if counts["UnattachedDisks"] != 1 || counts["UnusedVMDisks"] != 7 || counts["RunningVM"] != 1 {
+		t.Errorf("findings = %v", counts)
+	}
+
+	for query, n := range backend.queries {
+		if strings.Contains(query, "microsoft.compute/virtualmachines") && n != 1 {
+			t.Errorf("VMs were queried %d times", n)
+		}
+	}
+	if len(backend.metrics) != 4 {
+		t.Errorf("metrics of %d VMs were fetched, want 4", len(backend.metrics))
+	}
+	for id, n := range backend.metrics {
+		if n != 1 {
+			t.Errorf("metrics of %s were fetched %d times", id, n)
+		}
+	}
+	// 両方のチェックで評価できなかった VM は1度だけ報告される
+	if errs := env.Errors.List(); len(errs) != 1 || errs[0].Name != "broken" {
+		t.Errorf("evaluation errors = %v", errs)
+	}
+}
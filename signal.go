@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// DefaultRequestTimeout is the timeout of each API request
+const DefaultRequestTimeout = 2 * time.Minute
+
+// timeoutFlags returns global flags for timeout
+func timeoutFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "timeout of the whole run (e.g. 30m). 0 means no timeout",
+		},
+		&cli.DurationFlag{
+			Name:  "requestTimeout",
+			Value: DefaultRequestTimeout,
+			Usage: "timeout of each API request. A timed out request is retried",
+		},
+	}
+}
+
+type interruptKey struct{}
+
+// newRunContext returns the root context of a check.
+// The context is cancelled by --timeout or the second interrupt.
+// The first interrupt only stops scheduling new work and in-flight requests are drained.
+func newRunContext(c *cli.Context) (context.Context, context.CancelFunc) {
+	parent := c.Context
+	cancelTimeout := func() {}
+	if d := c.Duration("timeout"); d > 0 {
+		parent, cancelTimeout = context.WithTimeout(parent, d)
+	}
+	ctx, interrupt, cancel := withInterrupt(parent)
+
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-sig:
+			logger.Warn("interrupted: waiting for in-flight requests. Press Ctrl-C again to cancel them")
+			interrupt()
+		case <-done:
+			return
+		}
+		select {
+		case <-sig:
+			cancel()
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sig)
+		close(done)
+		interrupt()
+		cancel()
+		cancelTimeout()
+	}
+}
+
+// withInterrupt returns the context which has the interrupt context.
+// interrupt stops scheduling new work, and cancel cancels the context.
+func withInterrupt(parent context.Context) (ctx context.Context, interrupt context.CancelFunc, cancel context.CancelFunc) {
+	ctx, cancel = context.WithCancel(parent)
+	interruptCtx, interrupt := context.WithCancel(ctx)
+	return context.WithValue(ctx, interruptKey{}, interruptCtx), interrupt, cancel
+}
+
+// interruptContext returns the context which is done when the run is interrupted.
+// It is used for scheduling new work.
+func interruptContext(ctx context.Context) context.Context {
+	if v, ok := ctx.Value(interruptKey{}).(context.Context); ok {
+		return v
+	}
+	return ctx
+}
+
+// interrupted returns true when no more work should be scheduled
+func interrupted(ctx context.Context) bool {
+	return interruptContext(ctx).Err() != nil
+}
+
+// incompleteReason returns why the run did not complete, or empty when completed
+func incompleteReason(ctx context.Context) string {
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return "timeout"
+	case ctx.Err() != nil:
+		return "cancelled"
+	case interrupted(ctx):
+		return "interrupted"
+	}
+	return ""
+}
+
+// runExitError returns the error with the exit code of the run
+func runExitError(ctx context.Context, errs *EvaluationErrors) error {
+	if err := errs.ExitError(); err != nil {
+		return err
+	}
+	if reason := incompleteReason(ctx); reason != "" {
+		return cli.NewExitError(fmt.Sprintf("the report is incomplete: %s", reason), WARNING)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+//go:build !release
+// +build !release
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
+	"github.com/urfave/cli/v2"
+)
+
+func TestIncompleteReason(t *testing.T) {
+	tests := []struct {
+		name        string
+		stop        func(interrupt, cancel context.CancelFunc)
+		want        string
+		interrupted bool
+	}{
+		{"completed", func(interrupt, cancel context.CancelFunc) {}, "", false},
+		{"interrupted", func(interrupt, cancel context.CancelFunc) { interrupt() }, "interrupted", true},
+		{"cancelled", func(interrupt, cancel context.CancelFunc) { cancel() }, "cancelled", true},
+	}
+	for _, tt := range tests {
+		ctx, interrupt, cancel := withInterrupt(context.Background())
+		tt.stop(interrupt, cancel)
+		if got := incompleteReason(ctx); got != tt.want {
+			t.Errorf("%s: incompleteReason() = %q, want %q", tt.name, got, tt.want)
+		}
+		if got := interrupted(ctx); got != tt.interrupted {
+			t.Errorf("%s: interrupted() = %v", tt.name, got)
+		}
+		// 割り込みだけではリクエストの context はキャンセルしない
+		if tt.want == "interrupted" && ctx.Err() != nil {
+			t.Errorf("%s: context is cancelled: %v", tt.name, ctx.Err())
+		}
+		interrupt()
+		cancel()
+	}
+
+	parent, cancelTimeout := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelTimeout()
+	ctx, interrupt, cancel := withInterrupt(parent)
+	defer cancel()
+	defer interrupt()
+	<-ctx.Done()
+	if got := incompleteReason(ctx); got != "timeout" {
+		t.Errorf("incompleteReason() after the deadline = %q, want timeout", got)
+	}
+}
+
+func TestRunExitError(t *testing.T) {
+	completed, interrupt, cancel := withInterrupt(context.Background())
+	defer cancel()
+	defer interrupt()
+	incomplete, interruptIncomplete, cancelIncomplete := withInterrupt(context.Background())
+	defer cancelIncomplete()
+	interruptIncomplete()
+
+	withErrors := NewEvaluationErrors(false)
+	withErrors.Add("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1", "vm1", errors.New("throttled"))
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		errs *EvaluationErrors
+		code int
+	}{
+		{"completed", completed, NewEvaluationErrors(false), 0},
+		{"incomplete", incomplete, NewEvaluationErrors(false), WARNING},
+		{"evaluation errors", completed, withErrors, WARNING},
+	}
+	for _, tt := range tests {
+		err := runExitError(tt.ctx, tt.errs)
+		if tt.code == 0 {
+			if err != nil {
+				t.Errorf("%s: runExitError() = %v", tt.name, err)
+			}
+			continue
+		}
+		if exit, ok := err.(cli.ExitCoder); !ok || exit.ExitCode() != tt.code {
+			t.Errorf("%s: runExitError() = %v, want exit code %d", tt.name, err, tt.code)
+		}
+	}
+}
+
+// interruptingSource interrupts the run after the first request
+type interruptingSource struct {
+	MetricsSource
+	interrupt context.CancelFunc
+	mutex     sync.Mutex
+	calls     int
+}
+
+func (s *interruptingSource) MetricsConcurrency() int {
+	return 1
+}
+
+func (s *interruptingSource) FetchMetrics(ctx context.Context, targets []MetricTarget, query MetricQuery) []TargetMetrics {
+	s.mutex.Lock()
+	s.calls++
+	s.mutex.Unlock()
+	results := s.MetricsSource.FetchMetrics(ctx, targets, query)
+	s.interrupt()
+	return results
+}
+
+func TestFetchTargetMetricsInterrupted(t *testing.T) {
+	backend := &FakeBackend{Metrics: map[string]map[string][]insights.MetricValue{}}
+	var targets []MetricTarget
+	for _, name := range []string{"vm1", "vm2", "vm3", "vm4"} {
+		id := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/" + name
+		backend.Metrics[strings.ToLower(id)] = map[string][]insights.MetricValue{"Percentage CPU": fakeMetricValues(10)}
+		backend.Resources = append(backend.Resources, map[string]interface{}{"id": id, "type": "microsoft.compute/virtualmachines"})
+		targets = append(targets, MetricTarget{ID: id, Name: name})
+	}
+
+	ctx, interrupt, cancel := withInterrupt(context.Background())
+	defer cancel()
+	source := &interruptingSource{MetricsSource: backend, interrupt: interrupt}
+	var evaluated int
+	query := MetricQuery{MetricNames: []string{"Percentage CPU"}, Aggregations: []string{"Average"}}
+	err := FetchTargetMetrics(ctx, source, targets, query, NewEvaluationErrors(false), func(int, map[string][]insights.MetricValue) {
+		evaluated++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 割り込まれた後は新しいリソースの取得を開始しない
+	if source.calls != 1 || evaluated != 1 {
+		t.Errorf("calls = %d, evaluated = %d, want 1", source.calls, evaluated)
+	}
+}
+
+// stubCheck returns the findings, or waits for the run to be stopped in Inventory when stop is set
+type stubCheck struct {
+	id       string
+	findings []Finding
+	stop     func(ctx context.Context) error
+}
+
+func (s stubCheck) ID() string          { return s.id }
+func (s stubCheck) Description() string { return s.id }
+func (s stubCheck) OutputName() string  { return "result_" + s.id }
+func (s stubCheck) Categories() []Category {
+	return []Category{{ID: s.id, Title: s.id}}
+}
+
+func (s stubCheck) Inventory(ctx context.Context, env *CheckEnv) (interface{}, error) {
+	if s.stop != nil {
+		return nil, s.stop(ctx)
+	}
+	return nil, nil
+}
+
+func (s stubCheck) Evaluate(ctx context.Context, env *CheckEnv, resources interface{}) ([]Finding, error) {
+	return s.findings, nil
+}
+
+func TestRunChecksIncomplete(t *testing.T) {
+	fixture, err := LoadFakeAzureFixture("sample/fake-azure.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewFakeAzureHandler(fixture))
+	defer server.Close()
+
+	waitStopped := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	// 2回目の割り込みで実行中のリクエストもキャンセルされる
+	interruptTwice := func(ctx context.Context) error {
+		p, err := os.FindProcess(os.Getpid())
+		if err != nil {
+			return err
+		}
+		// 続けて送ったシグナルはまとめられるため、1回目が処理されてから送る
+		p.Signal(os.Interrupt)
+		<-interruptContext(ctx).Done()
+		p.Signal(os.Interrupt)
+		return waitStopped(ctx)
+	}
+	failed := func(ctx context.Context) error {
+		return errors.New("invalid query")
+	}
+
+	tests := []struct {
+		name       string
+		args       []string
+		stop       func(ctx context.Context) error
+		incomplete string
+		err        string
+	}{
+		{"timeout", []string{"--timeout", "200ms"}, waitStopped, "timeout", "the report is incomplete: timeout"},
+		{"interrupted", nil, interruptTwice, "cancelled", "the report is incomplete: cancelled"},
+		{"failed", nil, failed, "", "invalid query"},
+	}
+	for _, tt := range tests {
+		if tt.name == "interrupted" && runtime.GOOS == "windows" {
+			continue
+		}
+		dir, err := ioutil.TempDir("", "incomplete")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		done := stubCheck{id: "done", findings: []Finding{{Check: "done", Category: "done", ResourceName: "disk1"}}}
+		checks := []Check{done, stubCheck{id: "stopped", stop: tt.stop}, stubCheck{id: "skipped"}}
+		app := newApp()
+		app.ExitErrHandler = func(*cli.Context, error) {}
+		app.Commands = append(app.Commands, &cli.Command{
+			Name: "test",
+			Action: func(c *cli.Context) error {
+				return RunChecks(c, checks, "test", "result_test")
+			},
+		})
+		args := []string{"advisor", "--armEndpoint", server.URL, "--authMethod", "none", "--allSubscriptions", "--format", "json", "--output-dir", dir}
+		args = append(append(args, tt.args...), "test")
+
+		err = app.Run(args)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: err = %v, want %s", tt.name, err, tt.err)
+		}
+		b, readErr := ioutil.ReadFile(filepath.Join(dir, "result_test.json"))
+		if tt.incomplete == "" {
+			// 中断以外の失敗ではレポートを出力しない
+			if readErr == nil {
+				t.Errorf("%s: report is written", tt.name)
+			}
+			continue
+		}
+		if readErr != nil {
+			t.Errorf("%s: %v", tt.name, readErr)
+			continue
+		}
+		var report FindingsReport
+		if err := json.Unmarshal(b, &report); err != nil {
+			t.Fatal(err)
+		}
+		// 完了したチェックの結果は残る
+		if report.Run.Incomplete != tt.incomplete || strings.Join(report.Run.Checks, ",") != "done" || len(report.Findings) != 1 || report.Findings[0].ResourceName != "disk1" {
+			t.Errorf("%s: report = %+v", tt.name, report)
+		}
+	}
+}
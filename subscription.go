@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/resources/mgmt/2019-11-01/managementgroups"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-06-01/subscriptions"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/urfave/cli/v2"
+)
+
+// SubscriptionScope is target scope of the check
+type SubscriptionScope struct {
+	SubscriptionIDs   []string
+	ManagementGroupID string
+	AllSubscriptions  bool
+}
+
+// scopeFlags returns global flags for target subscriptions
+func scopeFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "subscriptionID",
+			Usage: "target subscription ID (can be specified multiple times or separated by comma)",
+		},
+		&cli.StringFlag{
+			Name:  "managementGroupID",
+			Usage: "target management group ID (all subscriptions under the group are checked)",
+		},
+		&cli.BoolFlag{
+			Name:  "allSubscriptions",
+			Usage: "check all subscriptions visible to the credential",
+		},
+	}
+}
+
+// NewSubscriptionScope returns *SubscriptionScope from global flags
+func NewSubscriptionScope(c *cli.Context) *SubscriptionScope {
+	var ids []string
+	for _, v := range c.StringSlice("subscriptionID") {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return &SubscriptionScope{
+		SubscriptionIDs:   ids,
+		ManagementGroupID: c.String("managementGroupID"),
+		AllSubscriptions:  c.Bool("allSubscriptions"),
+	}
+}
+
+// Resolve returns subscription IDs included in the scope without duplication.
+// baseURI is the endpoint of Azure Resource Manager.
+func (s *SubscriptionScope) Resolve(ctx context.Context, a autorest.Authorizer, baseURI string) ([]string, error) {
+	ids := append([]string{}, s.SubscriptionIDs...)
+
+	if s.ManagementGroupID != "" {
+		r, err := listManagementGroupSubscriptions(ctx, a, baseURI, s.ManagementGroupID)
+		if err != nil {
+			return nil, fmt.Errorf("list subscriptions of management group %s failed: %v", s.ManagementGroupID, err)
+		}
+		ids = append(ids, r...)
+	}
+
+	if s.AllSubscriptions {
+		r, err := listSubscriptions(ctx, a, baseURI)
+		if err != nil {
+			return nil, fmt.Errorf("list subscriptions failed: %v", err)
+		}
+		ids = append(ids, r...)
+	}
+
+	var result []string
+	found := map[string]bool{}
+	for _, id := range ids {
+		key := strings.ToLower(id)
+		if found[key] {
+			continue
+		}
+		found[key] = true
+		result = append(result, id)
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no target subscription: specify --subscriptionID, --managementGroupID or --allSubscriptions")
+	}
+	return result, nil
+}
+
+func listSubscriptions(ctx context.Context, a autorest.Authorizer, baseURI string) ([]string, error) {
+	client := subscriptions.NewClientWithBaseURI(baseURI)
+	client.Authorizer = a
+
+	var result []string
+	it, err := client.ListComplete(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for it.NotDone() {
+		s := it.Value()
+		// 無効化されたサブスクリプションのリソースは参照できないため除外
+		if s.SubscriptionID != nil && s.State == subscriptions.Enabled {
+			result = append(result, *s.SubscriptionID)
+		}
+		if err := it.NextWithContext(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func listManagementGroupSubscriptions(ctx context.Context, a autorest.Authorizer, baseURI string, groupID string) ([]string, error) {
+	client := managementgroups.NewClientWithBaseURI(baseURI)
+	client.Authorizer = a
+
+	var result []string
+	it, err := client.GetDescendantsComplete(ctx, groupID, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	for it.NotDone() {
+		d := it.Value()
+		if d.Type != nil && d.Name != nil && strings.EqualFold(*d.Type, "/subscriptions") {
+			result = append(result, *d.Name)
+		}
+		if err := it.NextWithContext(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
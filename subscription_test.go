@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+func TestSubscriptionScopeResolve(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/subscriptions" && r.URL.Query().Get("page") == "":
+			w.Write([]byte(`{"value":[
+				{"subscriptionId":"sub-a","state":"Enabled"},
+				{"subscriptionId":"sub-disabled","state":"Disabled"}
+			],"nextLink":"` + server.URL + `/subscriptions?page=2"}`))
+		case r.URL.Path == "/subscriptions":
+			w.Write([]byte(`{"value":[{"subscriptionId":"SUB-B","state":"Enabled"}]}`))
+		case strings.HasSuffix(r.URL.Path, "/managementGroups/mg1/descendants"):
+			w.Write([]byte(`{"value":[
+				{"id":"/providers/Microsoft.Management/managementGroups/mg2","type":"/providers/Microsoft.Management/managementGroups","name":"mg2"},
+				{"id":"/subscriptions/sub-b","type":"/subscriptions","name":"sub-b"},
+				{"id":"/subscriptions/sub-c","type":"/subscriptions","name":"sub-c"}
+			]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"NotFound","message":"not found"}}`))
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		scope SubscriptionScope
+		want  string
+		err   string
+	}{
+		{"subscription IDs", SubscriptionScope{SubscriptionIDs: []string{"sub-a", "sub-b"}}, "sub-a,sub-b", ""},
+		{"duplicated IDs", SubscriptionScope{SubscriptionIDs: []string{"sub-a", "SUB-A", "sub-b", "sub-a"}}, "sub-a,sub-b", ""},
+		{"all subscriptions", SubscriptionScope{AllSubscriptions: true}, "sub-a,SUB-B", ""},
+		{"management group", SubscriptionScope{ManagementGroupID: "mg1"}, "sub-b,sub-c", ""},
+		{"all scopes", SubscriptionScope{SubscriptionIDs: []string{"Sub-C"}, ManagementGroupID: "mg1", AllSubscriptions: true}, "Sub-C,sub-b,sub-a", ""},
+		{"no subscription", SubscriptionScope{}, "", "no target subscription: specify --subscriptionID, --managementGroupID or --allSubscriptions"},
+		{"unknown management group", SubscriptionScope{ManagementGroupID: "unknown"}, "", "list subscriptions of management group unknown failed"},
+	}
+	for _, tt := range tests {
+		ids, err := tt.scope.Resolve(context.Background(), autorest.NullAuthorizer{}, server.URL)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := strings.Join(ids, ","); got != tt.want {
+			t.Errorf("%s: Resolve() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,22 +2,40 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"sync"
+	"encoding/json"
 
-	"github.com/urfave/cli/v2"
-	"golang.org/x/sync/semaphore"
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/mgmt/2018-09-01/insights"
 )
 
 type VM struct {
-	ID            string       `json:"id"`
-	ResourceGroup string       `json:"resourceGroup"`
-	Name          string       `json:"name"`
-	Location      string       `json:"location"`
-	Properties    VMProperties `json:"properties"`
-	Zones         []string     `json:"zones"`
+	ID             string       `json:"id"`
+	SubscriptionID string       `json:"subscriptionId"`
+	ResourceGroup  string       `json:"resourceGroup"`
+	Name           string       `json:"name"`
+	Location       string       `json:"location"`
+	Properties     VMProperties `json:"properties"`
+	Zones          []string     `json:"zones"`
 }
 
+// VMs is rows of VM decoded from Resource Graph
+type VMs []VM
+
+// AppendRow decodes the row into VM and appends it
+func (r *VMs) AppendRow(row []byte) error {
+	var v VM
+	if err := json.Unmarshal(row, &v); err != nil {
+		return err
+	}
+	*r = append(*r, v)
+	return nil
+}
+
+// Len returns the number of rows
+func (r *VMs) Len() int { return len(*r) }
+
+// Truncate drops the rows after the first n
+func (r *VMs) Truncate(n int) { *r = (*r)[:n] }
+
 type VMProperties struct {
 	StorageProfile struct {
 		DataDisks DataDisks `json:"dataDisks"`
@@ -48,138 +66,132 @@ type RunningVM struct {
 	PercentageCPUMAXPerMonth float64
 }
 
-func CheckVM(c *cli.Context) error {
-	client, err := NewClient(c.String("subscriptionID"))
-	if err != nil {
-		return err
-	}
-	fmt.Println("-------------------  getRunningVM -----------------------")
-	vms, err4 := getRunningVM(client, client.SubscriptionID)
-	if err4 != nil {
-		return err4
-	}
-	fmt.Println("---------------------------------------------------------------")
+// vmCheck reports running VMs with their CPU usage
+type vmCheck struct{}
 
-	m := map[string][]RunningVM{}
-	m["RunningVM"] = *vms
-	outputToFile(m, "result_vms.html", "vms.tmpl.html")
-	outputToFile(m, "result_vms.csv", "vms.tmpl.csv")
-	return nil
-}
+func (vmCheck) ID() string             { return "vm" }
+func (vmCheck) Description() string    { return "Advisor for VM" }
+func (vmCheck) OutputName() string     { return "result_vms" }
+func (vmCheck) Categories() []Category { return []Category{categoryRunningVM} }
 
-func getVM(client *Client, subscriptionID string) (*[]VM, error) {
-	project := []ResourceGraphQueryProject{
-		{columnName: "id", queryProperty: "id"},
-		{columnName: "resourceGroup", queryProperty: "resourceGroup"},
-		{columnName: "name", queryProperty: "name"},
-		{columnName: "properties", queryProperty: "properties"},
+// Inventory returns []VM
+func (vmCheck) Inventory(ctx context.Context, env *CheckEnv) (interface{}, error) {
+	vms, err := getVM(ctx, env.Inventory, env.SubscriptionIDs)
+	if err != nil {
+		return nil, err
 	}
+	return *vms, nil
+}
 
-	qr := buildQueryRequest(
-		`resources | where type =~ "microsoft.compute/virtualmachines"`,
-		subscriptionID,
-		project,
-	)
-
-	r, err := FetchResourceGraphData(context.TODO(), client, qr, &VM{})
+func (vmCheck) Evaluate(ctx context.Context, env *CheckEnv, resources interface{}) ([]Finding, error) {
+	vms, err := evaluateRunningVMs(ctx, env.Metrics, resources.([]VM), env.Errors)
 	if err != nil {
-		fmt.Println(qr.query)
 		return nil, err
 	}
+	return runningVMFindings(*vms), nil
+}
+
+// categoryRunningVM is the category of the vm check
+var categoryRunningVM = Category{ID: "RunningVM", Title: "Running VM"}
+
+func getVM(ctx context.Context, inventory ResourceInventory, subscriptionIDs []string) (*[]VM, error) {
+	query := NewKQLQuery("resources").
+		Where(EqFold("type", "microsoft.compute/virtualmachines")).
+		Project(Cols("id", "subscriptionId", "resourceGroup", "name", "location", "properties")...)
+	qr := buildQueryRequest(query, subscriptionIDs)
+
 	var result []VM
-	for _, d := range r {
-		vm := *d.(*VM)
-		result = append(result, vm)
+	if err := FetchResourceGraphData(ctx, inventory, qr, (*VMs)(&result)); err != nil {
+		logger.Error("failed to query VMs", "query", qr.query)
+		return nil, err
 	}
 
 	return &result, nil
 }
 
-func getRunningVM(client *Client, subscriptionID string) (*[]RunningVM, error) {
-
+// evaluateRunningVMs returns the VMs which have CPU metrics in the lookback window
+func evaluateRunningVMs(ctx context.Context, metrics MetricsSource, vms []VM, errs *EvaluationErrors) (*[]RunningVM, error) {
 	// --------------------------------------------
-	// 仮想マシンの一覧を取得
+	// 仮想マシンのメトリックを取得
 	// --------------------------------------------
-	vms, err := getVM(client, subscriptionID)
+	var runningVMs []RunningVM
+	query := MetricQuery{
+		MetricNames:  []string{"Percentage CPU"},
+		Aggregations: []string{"Average", "Maximum"},
+	}
+	err := FetchTargetMetrics(ctx, metrics, vmMetricTargets(vms), query, errs, func(i int, values map[string][]insights.MetricValue) {
+		if runningVM := evaluateRunningVM(vms[i], values); runningVM != nil {
+			runningVMs = append(runningVMs, *runningVM)
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
-	// --------------------------------------------
-	// 取得した仮想マシンのメトリックを取得
-	// --------------------------------------------
-	var runningVMs []RunningVM
 
-	var wg sync.WaitGroup
-	mutex := &sync.Mutex{}
-
-	s := semaphore.NewWeighted(QueryConcurrency)
-
-	for _, elem := range *vms {
-		elem := elem
-		wg.Add(1)
-		s.Acquire(context.Background(), 1)
-
-		go func() error {
-			defer s.Release(1)
-			defer wg.Done()
-			// 過去1か月1つでもメトリックがある VM を利用している VM とする
-			input := FetchMetricDataInput{
-				subscriptionID:   subscriptionID,
-				namespace:        "microsoft.compute/virtualmachines",
-				resource:         elem.Name,
-				resourceGroup:    elem.ResourceGroup,
-				aggregation:      "Average",
-				metricNames:      []string{"Percentage CPU"},
-				timeDurationHour: 24 * 30,
-			}
-			fmt.Printf("Processing... get vm metric:Average:%s\n", elem.Name)
-			metricsList, err := FetchMetricData(context.TODO(), client, input)
-			if err != nil {
-				return err
-			}
-
-			// CPU 使用率がない VM はスキップ
-			if len(metricsList["Percentage CPU"]) == 0 {
-				return nil
-			}
-			// 1か月全体の平均を算出
-			var avg float64
-			for _, cpu := range metricsList["Percentage CPU"] {
-				avg += *cpu.Average
-			}
-			avg /= float64(len(metricsList["Percentage CPU"]))
-
-			// 1か月間の内の最大CPU使用率を取得
-			// ToDo: メトリックのアグリゲーションを一度に取得する
-			var max float64
-			input = FetchMetricDataInput{
-				subscriptionID:   subscriptionID,
-				namespace:        "microsoft.compute/virtualmachines",
-				resource:         elem.Name,
-				resourceGroup:    elem.ResourceGroup,
-				aggregation:      "Maximum",
-				metricNames:      []string{"Percentage CPU"},
-				timeDurationHour: 24 * 30,
-			}
-			fmt.Printf("Processing... get vm metric:Maximum:%s\n", elem.Name)
-			metricsList, err = FetchMetricData(context.TODO(), client, input)
-			if err != nil {
-				return err
-			}
-			for _, cpu := range metricsList["Percentage CPU"] {
-				if max < *cpu.Maximum {
-					max = *cpu.Maximum
-				}
-			}
-
-			mutex.Lock()
-			runningVMs = append(runningVMs, RunningVM{VM: elem, PercentageCPUPerMonth: avg, PercentageCPUMAXPerMonth: max})
-			mutex.Unlock()
-			return nil
-		}()
+	return &runningVMs, nil
+}
+
+// vmMetricTargets returns metric targets of the VMs
+func vmMetricTargets(vms []VM) []MetricTarget {
+	var targets []MetricTarget
+	for _, vm := range vms {
+		targets = append(targets, MetricTarget{
+			ID:       vm.ID,
+			Name:     vm.Name,
+			Location: vm.Location,
+		})
 	}
-	wg.Wait()
+	return targets
+}
 
-	return &runningVMs, nil
+// runningVMFindings returns findings of the running VMs with CPU usage
+func runningVMFindings(vms []RunningVM) []Finding {
+	var findings []Finding
+	for _, v := range vms {
+		findings = append(findings, Finding{
+			Check:          "vm",
+			Category:       categoryRunningVM.ID,
+			Severity:       SeverityInfo,
+			ResourceID:     v.VM.ID,
+			ResourceName:   v.VM.Name,
+			SubscriptionID: v.VM.SubscriptionID,
+			ResourceGroup:  v.VM.ResourceGroup,
+			Location:       v.VM.Location,
+			Reason:         "VM is running in the lookback window; compare the CPU usage with the VM size",
+			Evidence: map[string]interface{}{
+				"VMSize":                   v.VM.Properties.HardwareProfile.VMSize,
+				"PercentageCPUPerMonth":    Percentage(v.PercentageCPUPerMonth),
+				"PercentageCPUMAXPerMonth": Percentage(v.PercentageCPUMAXPerMonth),
+			},
+			Resource: v.VM,
+		})
+	}
+	return findings
+}
+
+// evaluateRunningVM returns *RunningVM with CPU usage, or nil when the VM has no CPU metric
+func evaluateRunningVM(elem VM, metricsList map[string][]insights.MetricValue) *RunningVM {
+	// 期間内に1つでもメトリックがある VM を利用している VM とする
+	// CPU 使用率がない VM はスキップ
+	if len(metricsList["Percentage CPU"]) == 0 {
+		return nil
+	}
+
+	// 期間全体の平均と期間内の最大CPU使用率を算出
+	var avg, max float64
+	var count int
+	for _, cpu := range metricsList["Percentage CPU"] {
+		if cpu.Average != nil {
+			avg += *cpu.Average
+			count++
+		}
+		if cpu.Maximum != nil && max < *cpu.Maximum {
+			max = *cpu.Maximum
+		}
+	}
+	if count > 0 {
+		avg /= float64(count)
+	}
 
+	return &RunningVM{VM: elem, PercentageCPUPerMonth: avg, PercentageCPUMAXPerMonth: max}
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// MetricWindow is the time window and granularity of metrics to decide whether a resource is used
+type MetricWindow struct {
+	Lookback time.Duration
+	Interval string
+}
+
+// Default metric window is 30 days with daily granularity
+const (
+	DefaultLookback = "30d"
+	DefaultInterval = "PT24H"
+)
+
+// DefaultMetricWindow is used when no window is configured
+var DefaultMetricWindow = MetricWindow{Lookback: 30 * 24 * time.Hour, Interval: DefaultInterval}
+
+// metricRetention is the retention period of platform metrics in Azure Monitor
+const metricRetention = 93 * 24 * time.Hour
+
+// supportedIntervals is the time grains supported by Azure Monitor metrics
+var supportedIntervals = map[string]time.Duration{
+	"PT1M":  time.Minute,
+	"PT5M":  5 * time.Minute,
+	"PT15M": 15 * time.Minute,
+	"PT30M": 30 * time.Minute,
+	"PT1H":  time.Hour,
+	"PT6H":  6 * time.Hour,
+	"PT12H": 12 * time.Hour,
+	"PT24H": 24 * time.Hour,
+	"P1D":   24 * time.Hour,
+}
+
+// metricWindowFlags returns flags for the metric window.
+// Command flags have no default value so that the global flags are used when they are not set.
+func metricWindowFlags(global bool) []cli.Flag {
+	lookback := &cli.StringFlag{
+		Name:  "lookback",
+		Usage: "time window of metrics to decide whether a resource is used (e.g. 14d, 36h)",
+	}
+	interval := &cli.StringFlag{
+		Name:  "interval",
+		Usage: "granularity of metrics (PT1M|PT5M|PT15M|PT30M|PT1H|PT6H|PT12H|PT24H|P1D)",
+	}
+	if global {
+		lookback.Value = DefaultLookback
+		interval.Value = DefaultInterval
+	}
+	return []cli.Flag{lookback, interval}
+}
+
+// lookupStringFlag returns the value of the nearest context where the flag is set, or the global value
+func lookupStringFlag(c *cli.Context, name string) string {
+	lineage := c.Lineage()
+	for _, ctx := range lineage {
+		for _, n := range ctx.LocalFlagNames() {
+			if n == name {
+				return ctx.String(name)
+			}
+		}
+	}
+	// どこでも指定されていない場合はグローバルフラグのデフォルト値を使う
+	for i := len(lineage) - 1; i >= 0; i-- {
+		if v := lineage[i].String(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// NewMetricWindow returns MetricWindow from flags
+func NewMetricWindow(c *cli.Context) (MetricWindow, error) {
+	lookback, err := parseLookback(lookupStringFlag(c, "lookback"))
+	if err != nil {
+		return MetricWindow{}, err
+	}
+	w := MetricWindow{
+		Lookback: lookback,
+		Interval: strings.ToUpper(lookupStringFlag(c, "interval")),
+	}
+	if err := w.Validate(); err != nil {
+		return MetricWindow{}, err
+	}
+	return w, nil
+}
+
+// parseLookback parses days (e.g. 14d) or a duration of Go (e.g. 36h)
+func parseLookback(v string) (time.Duration, error) {
+	if strings.HasSuffix(v, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(v, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid lookback: %s", v)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lookback: %s", v)
+	}
+	return d, nil
+}
+
+// Validate checks the window is supported by Azure Monitor
+func (w MetricWindow) Validate() error {
+	interval, ok := supportedIntervals[w.Interval]
+	if !ok {
+		return fmt.Errorf("unsupported interval: %s", w.Interval)
+	}
+	if w.Lookback <= 0 {
+		return fmt.Errorf("lookback must be positive: %s", w.LookbackString())
+	}
+	if w.Lookback > metricRetention {
+		return fmt.Errorf("lookback %s exceeds the metric retention of Azure Monitor (93d)", w.LookbackString())
+	}
+	if interval > w.Lookback {
+		return fmt.Errorf("interval %s is longer than lookback %s", w.Interval, w.LookbackString())
+	}
+	return nil
+}
+
+// LookbackString returns lookback in days when it is a multiple of a day
+func (w MetricWindow) LookbackString() string {
+	const day = 24 * time.Hour
+	if w.Lookback > 0 && w.Lookback%day == 0 {
+		return fmt.Sprintf("%dd", w.Lookback/day)
+	}
+	return w.Lookback.String()
+}
+
+// Timespan returns the timespan parameter of Azure Monitor which ends at end
+func (w MetricWindow) Timespan(end time.Time) string {
+	end = end.UTC()
+	start := end.Add(-w.Lookback)
+	return fmt.Sprintf("%s/%s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetricWindowValidate(t *testing.T) {
+	tests := []struct {
+		lookback string
+		interval string
+		valid    bool
+	}{
+		{"30d", "PT24H", true},
+		{"36h", "PT1H", true},
+		{"93d", "P1D", true},
+		{"94d", "P1D", false},
+		{"1h", "PT6H", false},
+		{"14d", "PT2H", false},
+		{"14x", "PT1H", false},
+	}
+	for _, tt := range tests {
+		lookback, err := parseLookback(tt.lookback)
+		if err == nil {
+			err = MetricWindow{Lookback: lookback, Interval: tt.interval}.Validate()
+		}
+		if (err == nil) != tt.valid {
+			t.Errorf("%s/%s: err = %v, want valid = %v", tt.lookback, tt.interval, err, tt.valid)
+		}
+	}
+}
+
+func TestMetricWindowTimespan(t *testing.T) {
+	w := MetricWindow{Lookback: 14 * 24 * time.Hour, Interval: "PT1H"}
+	end := time.Date(2020, 3, 15, 0, 0, 0, 0, time.UTC)
+	if got, want := w.Timespan(end), "2020-03-01T00:00:00Z/2020-03-15T00:00:00Z"; got != want {
+		t.Errorf("Timespan = %s, want %s", got, want)
+	}
+	if got := w.LookbackString(); got != "14d" {
+		t.Errorf("LookbackString = %s", got)
+	}
+}